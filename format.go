@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/anchore/syft/syft/format/cyclonedxjson"
+	"github.com/anchore/syft/syft/format/cyclonedxxml"
+	"github.com/anchore/syft/syft/format/spdxjson"
+	"github.com/anchore/syft/syft/format/spdxtagvalue"
+	"github.com/anchore/syft/syft/format/syftjson"
+	"github.com/anchore/syft/syft/sbom"
+)
+
+// SBOMFormat describes an output format that can be requested from /generate-sbom
+type SBOMFormat struct {
+	ID          sbom.FormatID
+	Name        string
+	ContentType string
+	Extension   string
+	Aliases     []string
+	newEncoder  func() (sbom.FormatEncoder, error)
+}
+
+// Encoder creates a syft encoder for the format
+func (f SBOMFormat) Encoder() (sbom.FormatEncoder, error) {
+	return f.newEncoder()
+}
+
+// Supported output formats, the first entry is the default
+var sbomFormats = []SBOMFormat{
+	{
+		ID:          cyclonedxjson.ID,
+		Name:        "CycloneDX JSON",
+		ContentType: "application/vnd.cyclonedx+json",
+		Extension:   ".cyclonedx.json",
+		Aliases:     []string{"cyclonedx", "cdx-json"},
+		newEncoder: func() (sbom.FormatEncoder, error) {
+			return cyclonedxjson.NewFormatEncoderWithConfig(cyclonedxjson.DefaultEncoderConfig())
+		},
+	},
+	{
+		ID:          cyclonedxxml.ID,
+		Name:        "CycloneDX XML",
+		ContentType: "application/vnd.cyclonedx+xml",
+		Extension:   ".cyclonedx.xml",
+		Aliases:     []string{"cdx-xml"},
+		newEncoder: func() (sbom.FormatEncoder, error) {
+			return cyclonedxxml.NewFormatEncoderWithConfig(cyclonedxxml.DefaultEncoderConfig())
+		},
+	},
+	{
+		ID:          spdxjson.ID,
+		Name:        "SPDX JSON",
+		ContentType: "application/spdx+json",
+		Extension:   ".spdx.json",
+		Aliases:     []string{"spdx"},
+		newEncoder: func() (sbom.FormatEncoder, error) {
+			return spdxjson.NewFormatEncoderWithConfig(spdxjson.DefaultEncoderConfig())
+		},
+	},
+	{
+		ID:          spdxtagvalue.ID,
+		Name:        "SPDX tag-value",
+		ContentType: "text/spdx",
+		Extension:   ".spdx",
+		Aliases:     []string{"spdx-tv"},
+		newEncoder: func() (sbom.FormatEncoder, error) {
+			return spdxtagvalue.NewFormatEncoderWithConfig(spdxtagvalue.DefaultEncoderConfig())
+		},
+	},
+	{
+		ID:          syftjson.ID,
+		Name:        "Syft JSON",
+		ContentType: "application/vnd.syft+json",
+		Extension:   ".syft.json",
+		Aliases:     []string{"syft", "json"},
+		newEncoder: func() (sbom.FormatEncoder, error) {
+			return syftjson.NewFormatEncoderWithConfig(syftjson.DefaultEncoderConfig())
+		},
+	},
+}
+
+// defaultSBOMFormat returns the format used when the client does not ask for one
+func defaultSBOMFormat() SBOMFormat {
+	return sbomFormats[0]
+}
+
+// allSBOMFormatIDs lists the format identifiers accepted in requests
+func allSBOMFormatIDs() []string {
+	ids := make([]string, 0, len(sbomFormats))
+	for _, f := range sbomFormats {
+		ids = append(ids, string(f.ID))
+	}
+	return ids
+}
+
+// lookupSBOMFormat finds a format by its ID or one of its aliases
+func lookupSBOMFormat(name string) (SBOMFormat, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, f := range sbomFormats {
+		if string(f.ID) == name {
+			return f, true
+		}
+		for _, alias := range f.Aliases {
+			if alias == name {
+				return f, true
+			}
+		}
+	}
+	return SBOMFormat{}, false
+}
+
+// formatFromAcceptHeader picks the SBOM media type an Accept header prefers, by q-value and then
+// by order. Media types with q=0 are refused, and no format is picked when application/json, the
+// JSON response, is preferred over every SBOM media type.
+func formatFromAcceptHeader(accept string) (SBOMFormat, bool) {
+	var best SBOMFormat
+	bestQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		if mediaType == contentTypeJSON {
+			best, bestQ = SBOMFormat{}, q
+			continue
+		}
+		for _, f := range sbomFormats {
+			if f.ContentType == mediaType {
+				best, bestQ = f, q
+				break
+			}
+		}
+	}
+	return best, best.ID != ""
+}
+
+// resolveSBOMFormat chooses the output format for a request. An explicit format
+// field wins over the Accept header; the second return value reports whether the
+// format was negotiated through the Accept header.
+func resolveSBOMFormat(requested string, accept string) (SBOMFormat, bool, error) {
+	if requested != "" {
+		f, ok := lookupSBOMFormat(requested)
+		if !ok {
+			return SBOMFormat{}, false, fmt.Errorf("unsupported SBOM format %q, allowed values: %s", requested, strings.Join(allSBOMFormatIDs(), ", "))
+		}
+		return f, false, nil
+	}
+
+	if f, ok := formatFromAcceptHeader(accept); ok {
+		return f, true, nil
+	}
+
+	return defaultSBOMFormat(), false, nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/anchore/syft/syft/source"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// GitSource is a git repository to catalog, at a branch, tag or commit and optionally only a subdirectory.
+// In a source string it is written as the URL with the other fields as a fragment query,
+// such as https://github.com/org/repo.git#ref=v1.2.0&subpath=services/api
+type GitSource struct {
+	URL string `json:"url"`
+	// Ref is a branch, a tag or a full reference name such as refs/pull/42/head, the default branch when empty
+	Ref string `json:"ref,omitempty"`
+	// Commit is checked out after cloning Ref, full or abbreviated
+	Commit  string `json:"commit,omitempty"`
+	Subpath string `json:"subpath,omitempty"`
+	// Credentials names the GIT_CREDENTIALS_<NAME>_* environment variables holding the secrets,
+	// so requests and stored sources never contain them
+	Credentials string `json:"credentials,omitempty"`
+}
+
+var (
+	// scpURLPattern matches scp-like SSH URLs such as git@github.com:org/repo.git
+	scpURLPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^/]`)
+	commitPattern = regexp.MustCompile(`^[0-9a-fA-F]{4,40}$`)
+	// credentialsNamePattern keeps credential references usable in environment variable names
+	credentialsNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+)
+
+// gitURLPrefixes are the URL schemes cataloged as git repositories
+var gitURLPrefixes = []string{"http://", "https://", "ssh://", "git://", "file://"}
+
+// requestSource combines the sbomSource and git fields of a request into one source string
+func requestSource(sbomSource string, sourceType string, git *GitSource) (string, error) {
+	if git == nil {
+		return sbomSource, nil
+	}
+	if sbomSource != "" {
+		return "", errors.New("provide either sbomSource or git, not both")
+	}
+	if sourceType != "" && sourceType != gitSourceType {
+		return "", fmt.Errorf("the git field needs source type git, not %s", sourceType)
+	}
+	if err := git.validate(); err != nil {
+		return "", err
+	}
+	return git.String(), nil
+}
+
+// isGitURL reports whether a source string names a git repository rather than a path or image
+func isGitURL(s string) bool {
+	for _, prefix := range gitURLPrefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return scpURLPattern.MatchString(s)
+}
+
+// parseGitSource reads a git source string, returning nil when the string isn't a git URL
+func parseGitSource(s string) (*GitSource, error) {
+	if !isGitURL(s) {
+		return nil, nil
+	}
+	repoURL, fragment, _ := strings.Cut(s, "#")
+	spec := &GitSource{URL: repoURL}
+	params, err := url.ParseQuery(fragment)
+	if err != nil {
+		return nil, fmt.Errorf("invalid git source options %q: %w", fragment, err)
+	}
+	for key, values := range params {
+		value := values[len(values)-1]
+		switch key {
+		case "ref":
+			spec.Ref = value
+		case "commit":
+			spec.Commit = value
+		case "subpath":
+			spec.Subpath = value
+		case "credentials":
+			spec.Credentials = value
+		default:
+			return nil, fmt.Errorf("unknown git source option %q, allowed options are ref, commit, subpath, credentials", key)
+		}
+	}
+	return spec, spec.validate()
+}
+
+// String writes the source in the form parseGitSource reads
+func (g GitSource) String() string {
+	params := url.Values{}
+	for key, value := range map[string]string{"ref": g.Ref, "commit": g.Commit, "subpath": g.Subpath, "credentials": g.Credentials} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+	if len(params) == 0 {
+		return g.URL
+	}
+	return g.URL + "#" + params.Encode()
+}
+
+// validate checks the fields of a git source before anything is cloned
+func (g GitSource) validate() error {
+	if !isGitURL(g.URL) {
+		return fmt.Errorf("invalid git URL %q, use an http(s), ssh, git or file URL or user@host:path", g.URL)
+	}
+	if strings.Contains(g.URL, "#") {
+		return fmt.Errorf("invalid git URL %q, give the options as fields rather than a fragment", g.URL)
+	}
+	if g.Commit != "" && !commitPattern.MatchString(g.Commit) {
+		return fmt.Errorf("invalid commit %q, expected a hexadecimal commit SHA", g.Commit)
+	}
+	if g.Ref != "" {
+		ref := plumbing.ReferenceName(g.Ref)
+		if !strings.HasPrefix(g.Ref, "refs/") {
+			ref = plumbing.NewBranchReferenceName(g.Ref)
+		}
+		if err := ref.Validate(); err != nil {
+			return fmt.Errorf("invalid ref %q: %w", g.Ref, err)
+		}
+	}
+	if g.Subpath != "" {
+		clean := filepath.Clean(g.Subpath)
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("invalid subpath %q, it must be relative and inside the repository", g.Subpath)
+		}
+	}
+	if g.Credentials != "" && !credentialsNamePattern.MatchString(g.Credentials) {
+		return fmt.Errorf("invalid credentials reference %q, use letters, digits and underscores", g.Credentials)
+	}
+	return nil
+}
+
+// displayURL is the repository URL without any password or token embedded in it
+func (g GitSource) displayURL() string {
+	u, err := url.Parse(g.URL)
+	if err != nil || u.User == nil {
+		return g.URL
+	}
+	u.User = url.User(u.User.Username())
+	return u.String()
+}
+
+// auth resolves the credentials reference from the environment: GIT_CREDENTIALS_<NAME>_TOKEN with an
+// optional _USERNAME for HTTP, or GIT_CREDENTIALS_<NAME>_SSH_KEY with an optional _SSH_KEY_PASSPHRASE for SSH.
+// Without a reference, public repositories are cloned anonymously and SSH uses the SSH agent.
+func (g GitSource) auth() (transport.AuthMethod, error) {
+	if g.Credentials == "" {
+		return nil, nil
+	}
+	prefix := "GIT_CREDENTIALS_" + strings.ToUpper(g.Credentials)
+	if strings.HasPrefix(g.URL, "http://") || strings.HasPrefix(g.URL, "https://") {
+		token := os.Getenv(prefix + "_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("credentials %q have no token, set %s_TOKEN", g.Credentials, prefix)
+		}
+		return &githttp.BasicAuth{Username: getEnv(prefix+"_USERNAME", "git"), Password: token}, nil
+	}
+
+	keyFile := os.Getenv(prefix + "_SSH_KEY")
+	if keyFile == "" {
+		return nil, fmt.Errorf("credentials %q have no SSH key, set %s_SSH_KEY to the key file", g.Credentials, prefix)
+	}
+	keys, err := gitssh.NewPublicKeysFromFile(getEnv(prefix+"_USERNAME", "git"), keyFile, os.Getenv(prefix+"_SSH_KEY_PASSPHRASE"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSH key for credentials %q: %w", g.Credentials, err)
+	}
+	return keys, nil
+}
+
+// GitCheckout is a cloned git source, remove it with Close
+type GitCheckout struct {
+	// Dir is the subdirectory to catalog, the clone itself without a subpath
+	Dir string
+	// Commit is the full SHA of the checked out commit
+	Commit string
+	// Source is the cloned source pinned to Commit
+	Source    GitSource
+	workspace *Workspace
+}
+
+// Alias names the SBOM's source after the repository, with the checked out commit as its version
+func (c *GitCheckout) Alias() source.Alias {
+	return source.Alias{Name: c.Source.displayURL(), Version: c.Commit}
+}
+
+// Close removes the clone
+func (c *GitCheckout) Close() {
+	c.workspace.Close()
+}
+
+// checkoutGitSource clones a git source into a workspace of its own and checks out its ref and
+// commit, within the workspace quota and clone timeout. Branches and tags without a commit are cloned shallow.
+func checkoutGitSource(ctx context.Context, spec GitSource) (*GitCheckout, error) {
+	auth, err := spec.auth()
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := workspaces.Create("git")
+	if err != nil {
+		return nil, err
+	}
+	checkout := &GitCheckout{workspace: ws}
+
+	logger.Log(fmt.Sprintf("Cloning %s ref %q commit %q into %s", spec.displayURL(), spec.Ref, spec.Commit, ws.Dir))
+	cloneCtx, cancel := workspaces.CloneContext(ctx)
+	defer cancel()
+	watchCtx, stop := ws.Watch(cloneCtx)
+	repo, err := fetchGitSource(watchCtx, ws.Dir, spec, auth)
+	if quotaErr := stop(); quotaErr != nil {
+		err = quotaErr
+	}
+	if err != nil {
+		checkout.Close()
+		if errors.Is(cloneCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			return nil, fmt.Errorf("cloning %s timed out after %s", spec.displayURL(), workspaces.cloneTimeout)
+		}
+		return nil, fmt.Errorf("failed to clone %s: %w", spec.displayURL(), err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		checkout.Close()
+		return nil, fmt.Errorf("failed to resolve the checked out commit: %w", err)
+	}
+	checkout.Commit = head.Hash().String()
+	checkout.Source = spec
+	checkout.Source.Commit = checkout.Commit
+
+	checkout.Dir = ws.Dir
+	if spec.Subpath != "" {
+		dir, err := subpathDir(ws.Dir, spec.Subpath)
+		if err != nil {
+			checkout.Close()
+			return nil, err
+		}
+		checkout.Dir = dir
+	}
+	logger.Log(fmt.Sprintf("Checked out %s at commit %s", spec.displayURL(), checkout.Commit))
+	return checkout, nil
+}
+
+// fetchGitSource clones the ref of a git source into dir and checks out its commit
+func fetchGitSource(ctx context.Context, dir string, spec GitSource, auth transport.AuthMethod) (*git.Repository, error) {
+	repo, err := cloneGitRef(ctx, dir, spec, auth)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Commit == "" {
+		return repo, nil
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(spec.Commit))
+	if err != nil {
+		return nil, fmt.Errorf("commit %s not found: %w", spec.Commit, err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open worktree: %w", err)
+	}
+	if err := worktree.Checkout(&git.CheckoutOptions{Hash: *hash, Force: true}); err != nil {
+		return nil, fmt.Errorf("failed to check out commit %s: %w", spec.Commit, err)
+	}
+	return repo, nil
+}
+
+// cloneGitRef clones the ref of a git source, trying a branch and then a tag for short names
+func cloneGitRef(ctx context.Context, dir string, spec GitSource, auth transport.AuthMethod) (*git.Repository, error) {
+	candidates := []plumbing.ReferenceName{""}
+	switch {
+	case strings.HasPrefix(spec.Ref, "refs/"):
+		candidates = []plumbing.ReferenceName{plumbing.ReferenceName(spec.Ref)}
+	case spec.Ref != "":
+		candidates = []plumbing.ReferenceName{plumbing.NewBranchReferenceName(spec.Ref), plumbing.NewTagReferenceName(spec.Ref)}
+	}
+
+	var lastErr error
+	for _, ref := range candidates {
+		opts := &git.CloneOptions{
+			URL:           spec.URL,
+			Auth:          auth,
+			ReferenceName: ref,
+			SingleBranch:  ref != "" || spec.Commit == "",
+			Tags:          git.NoTags,
+		}
+		// A commit may be anywhere in the history of the ref, or of any branch without one
+		if spec.Commit == "" {
+			opts.Depth = 1
+		}
+		repo, err := git.PlainCloneContext(ctx, dir, false, opts)
+		if err == nil {
+			return repo, nil
+		}
+		lastErr = err
+		if !errors.Is(err, plumbing.ErrReferenceNotFound) && !isNoMatchingRef(err) {
+			return nil, err
+		}
+		// Clear the failed attempt before trying the next kind of ref
+		if err := clearDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("ref %q not found: %w", spec.Ref, lastErr)
+}
+
+// isNoMatchingRef reports whether a clone failed because the remote has no such ref
+func isNoMatchingRef(err error) bool {
+	var noMatch git.NoMatchingRefSpecError
+	return errors.As(err, &noMatch)
+}
+
+// clearDir removes everything inside dir
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to clear clone directory: %w", err)
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return fmt.Errorf("failed to clear clone directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// subpathDir resolves a subpath of a clone, refusing symlinks that lead outside it
+func subpathDir(root string, subpath string) (string, error) {
+	dir, err := filepath.EvalSymlinks(filepath.Join(root, subpath))
+	if err != nil {
+		return "", fmt.Errorf("subpath %q not found in the repository: %w", subpath, err)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve clone directory: %w", err)
+	}
+	if rel, err := filepath.Rel(realRoot, dir); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("subpath %q leads outside the repository", subpath)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("subpath %q is not a directory in the repository", subpath)
+	}
+	return dir, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// testRepo is a bare repository served over file:// with the commits the tests check out
+type testRepo struct {
+	URL     string
+	Initial string // first commit on main, tagged v1
+	Main    string // head of main, adds the services/api subdirectory
+	Feature string // head of the feature branch, branched from main
+}
+
+// setupGitTest points the globals checkoutGitSource uses at temporary directories
+func setupGitTest(t *testing.T) {
+	t.Helper()
+	var err error
+	if logger, err = NewLogger(filepath.Join(t.TempDir(), "test.log")); err != nil {
+		t.Fatal(err)
+	}
+	if workspaces, err = NewWorkspaceManager(t.TempDir(), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestRepo builds a working repository with a few commits, a branch and a tag and pushes
+// them to a bare repository
+func newTestRepo(t *testing.T) testRepo {
+	t.Helper()
+	bare := t.TempDir()
+	if _, err := git.PlainInitWithOptions(bare, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: plumbing.Main},
+		Bare:        true,
+	}); err != nil {
+		t.Fatalf("failed to init bare repository: %v", err)
+	}
+
+	work := t.TempDir()
+	repo, err := git.PlainInitWithOptions(work, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: plumbing.Main},
+	})
+	if err != nil {
+		t.Fatalf("failed to init repository: %v", err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := func(message string, files map[string]string) string {
+		t.Helper()
+		for name, content := range files {
+			path := filepath.Join(work, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := worktree.AddGlob("."); err != nil {
+			t.Fatalf("failed to stage files: %v", err)
+		}
+		hash, err := worktree.Commit(message, &git.CommitOptions{
+			Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+		return hash.String()
+	}
+
+	r := testRepo{URL: "file://" + bare}
+	r.Initial = commit("initial", map[string]string{"README.md": "v1\n"})
+	if _, err := repo.CreateTag("v1", plumbing.NewHash(r.Initial), nil); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	if err := os.Symlink("../../..", filepath.Join(work, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	r.Main = commit("add api", map[string]string{"README.md": "v2\n", "services/api/go.mod": "module example.com/api\n"})
+
+	if err := worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("feature"), Create: true}); err != nil {
+		t.Fatalf("failed to create branch: %v", err)
+	}
+	r.Feature = commit("feature", map[string]string{"feature.txt": "feature\n"})
+
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{bare}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Push(&git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*"},
+	}); err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+	return r
+}
+
+func TestCloneGitRef(t *testing.T) {
+	setupGitTest(t)
+	repo := newTestRepo(t)
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    string
+		wantErr string
+	}{
+		{name: "default branch", want: repo.Main},
+		{name: "branch", ref: "feature", want: repo.Feature},
+		{name: "tag", ref: "v1", want: repo.Initial},
+		{name: "full ref", ref: "refs/heads/feature", want: repo.Feature},
+		{name: "missing ref", ref: "nope", wantErr: `ref "nope" not found`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cloned, err := cloneGitRef(context.Background(), dir, GitSource{URL: repo.URL, Ref: tt.ref}, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("clone failed: %v", err)
+			}
+			head, err := cloned.Head()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := head.Hash().String(); got != tt.want {
+				t.Errorf("expected commit %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckoutGitSource(t *testing.T) {
+	setupGitTest(t)
+	repo := newTestRepo(t)
+
+	tests := []struct {
+		name     string
+		spec     GitSource
+		want     string
+		wantFile string
+		noFile   string
+		wantErr  string
+	}{
+		{name: "default branch", spec: GitSource{}, want: repo.Main, wantFile: "services/api/go.mod", noFile: "feature.txt"},
+		{name: "branch", spec: GitSource{Ref: "feature"}, want: repo.Feature, wantFile: "feature.txt"},
+		{name: "tag", spec: GitSource{Ref: "v1"}, want: repo.Initial, wantFile: "README.md", noFile: "services"},
+		{name: "commit", spec: GitSource{Commit: repo.Initial}, want: repo.Initial, noFile: "services"},
+		{name: "abbreviated commit on a branch", spec: GitSource{Ref: "feature", Commit: repo.Main[:12]}, want: repo.Main, noFile: "feature.txt"},
+		{name: "subpath", spec: GitSource{Subpath: "services/api"}, want: repo.Main, wantFile: "go.mod"},
+		{name: "missing ref", spec: GitSource{Ref: "nope"}, wantErr: `ref "nope" not found`},
+		{name: "missing commit", spec: GitSource{Commit: strings.Repeat("0", 40)}, wantErr: "not found"},
+		{name: "missing subpath", spec: GitSource{Subpath: "services/web"}, wantErr: "not found in the repository"},
+		{name: "subpath escaping the repository", spec: GitSource{Subpath: "escape"}, wantErr: "leads outside the repository"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := tt.spec
+			spec.URL = repo.URL
+			checkout, err := checkoutGitSource(context.Background(), spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				if active := workspaces.Active(); active != 0 {
+					t.Errorf("expected the failed clone's workspace to be removed, %d still active", active)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkout failed: %v", err)
+			}
+			defer checkout.Close()
+
+			if checkout.Commit != tt.want {
+				t.Errorf("expected commit %s, got %s", tt.want, checkout.Commit)
+			}
+			if checkout.Source.Commit != tt.want {
+				t.Errorf("expected the source to be pinned to %s, got %s", tt.want, checkout.Source.Commit)
+			}
+			if tt.wantFile != "" {
+				if _, err := os.Stat(filepath.Join(checkout.Dir, tt.wantFile)); err != nil {
+					t.Errorf("expected %s in the checkout: %v", tt.wantFile, err)
+				}
+			}
+			if tt.noFile != "" {
+				if _, err := os.Stat(filepath.Join(checkout.Dir, tt.noFile)); err == nil {
+					t.Errorf("expected no %s in the checkout", tt.noFile)
+				}
+			}
+		})
+	}
+}
+
+func TestGitSourceSubpathValidation(t *testing.T) {
+	for _, subpath := range []string{"..", "../other", "/etc", "services/../../other"} {
+		spec := GitSource{URL: "https://example.com/repo.git", Subpath: subpath}
+		if err := spec.validate(); err == nil {
+			t.Errorf("expected subpath %q to be rejected", subpath)
+		}
+	}
+}
+
+func TestGitCheckoutAliasVersion(t *testing.T) {
+	setupGitTest(t)
+	repo := newTestRepo(t)
+
+	checkout, err := checkoutGitSource(context.Background(), GitSource{URL: repo.URL, Ref: "feature"})
+	if err != nil {
+		t.Fatalf("checkout failed: %v", err)
+	}
+	defer checkout.Close()
+
+	src, err := openSource(context.Background(), "dir:"+checkout.Dir, checkout.Alias(), "")
+	if err != nil {
+		t.Fatalf("failed to open source: %v", err)
+	}
+	defer src.Close()
+
+	description := src.Describe()
+	if description.Version != repo.Feature {
+		t.Errorf("expected source version %s, got %q", repo.Feature, description.Version)
+	}
+	if description.Name != repo.URL {
+		t.Errorf("expected source name %s, got %q", repo.URL, description.Name)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anchore/syft/syft/format"
+	"github.com/anchore/syft/syft/format/cpes"
+	"github.com/anchore/syft/syft/format/purls"
+	"github.com/gorilla/mux"
+)
+
+// importFormatIDs lists the formats an imported SBOM may be in, the output formats
+// and the plain purl and CPE lists syft also decodes
+func importFormatIDs() []string {
+	return append(allSBOMFormatIDs(), string(purls.ID), string(cpes.ID))
+}
+
+// importSBOM decodes a third-party SBOM and stores it next to the generated ones under a fresh ID.
+// The document is kept as sent when no format is requested and it is in a supported output format,
+// so scans and quality scores judge the vendor's document; otherwise it is re-encoded by syft.
+func importSBOM(ctx context.Context, name string, content []byte, requested string) (*SBOMResult, map[string]interface{}, error) {
+	doc, formatID, version, err := format.Decode(bytes.NewReader(content))
+	if err == nil && doc == nil {
+		err = errors.New("the document is empty")
+	}
+	if err != nil {
+		// A recognized format that fails to decode is reported as invalid rather than unknown
+		if formatID != "" {
+			return nil, nil, fmt.Errorf("invalid %s SBOM: %w", formatID, err)
+		}
+		return nil, nil, fmt.Errorf("unrecognized SBOM format, supported formats are %s: %w", strings.Join(importFormatIDs(), ", "), err)
+	}
+	detected, known := lookupSBOMFormat(string(formatID))
+
+	outputFormat := detected
+	normalized := requested != "" || !known
+	if normalized {
+		if outputFormat, _, err = resolveSBOMFormat(requested, ""); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var sbomID, sbomFile string
+	if normalized {
+		if sbomID, sbomFile, err = artifacts.Save(doc, outputFormat); err != nil {
+			return nil, nil, fmt.Errorf("failed to save imported SBOM: %w", err)
+		}
+		if content, err = os.ReadFile(sbomFile); err != nil {
+			return nil, nil, fmt.Errorf("failed to read imported SBOM file: %w", err)
+		}
+	} else if sbomID, sbomFile, err = artifacts.SaveRaw(content, outputFormat); err != nil {
+		return nil, nil, fmt.Errorf("failed to save imported SBOM: %w", err)
+	}
+
+	if name == "" {
+		name = doc.Source.Name
+	}
+	if err := store.SaveSBOM(ctx, newSBOMRecord(sbomID, "import:"+name, sbomFile, outputFormat, doc, content)); err != nil {
+		return nil, nil, err
+	}
+	logger.Log(fmt.Sprintf("Imported %s %s SBOM %s as %s with %d packages", formatID, version, name, sbomID, doc.Artifacts.Packages.PackageCount()))
+
+	result := &SBOMResult{
+		SBOMID:      sbomID,
+		File:        sbomFile,
+		Format:      outputFormat.Name,
+		FormatID:    string(outputFormat.ID),
+		ContentType: outputFormat.ContentType,
+		SBOMData:    string(content),
+	}
+	imported := map[string]interface{}{
+		"format":       string(formatID),
+		"version":      version,
+		"normalized":   normalized,
+		"packageCount": doc.Artifacts.Packages.PackageCount(),
+	}
+	return result, imported, nil
+}
+
+// importSBOMHandler stores an SBOM produced elsewhere in any format syft decodes. The document is
+// sent like an /upload artifact, format converts it to one of the output formats.
+func importSBOMHandler(w http.ResponseWriter, r *http.Request) {
+	limit := uploadLimit()
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20) // room for the multipart framing
+
+	ws, err := workspaces.Create("import")
+	if err != nil {
+		logger.Log(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer ws.Close()
+
+	file, form, err := receiveUpload(r, ws, limit)
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.Is(err, ErrUploadTooLarge) || errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		logger.Log(fmt.Sprintf("Rejected import: %v", err))
+		http.Error(w, err.Error(), status)
+		return
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		logger.Log(err.Error())
+		http.Error(w, "Failed to read imported SBOM", http.StatusInternalServerError)
+		return
+	}
+
+	name := ""
+	if form.filename != "" {
+		name = filepath.Base(file)
+	}
+	result, imported, err := importSBOM(r.Context(), name, content, form.format)
+	if err != nil {
+		logger.Log(fmt.Sprintf("Rejected import %s: %v", form.filename, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Location", "/sboms/"+result.SBOMID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sbomId":   result.SBOMID,
+		"sbomFile": result.File,
+		"format":   result.FormatID,
+		"imported": imported,
+		"sbomData": result.SBOMData,
+	})
+}
+
+// exportSBOMHandler returns a stored SBOM converted to the format chosen with the format
+// parameter or the Accept header, leaving the stored document as it is
+func exportSBOMHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	outputFormat, _, err := resolveSBOMFormat(r.URL.Query().Get("format"), r.Header.Get("Accept"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	doc, err := loadStoredSBOM(id)
+	if err != nil {
+		http.Error(w, err.Error(), sbomLookupStatus(err))
+		return
+	}
+	encoder, err := outputFormat.Encoder()
+	if err != nil {
+		logger.Log(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := encoder.Encode(&buf, *doc); err != nil {
+		logger.Log(fmt.Sprintf("Failed to export SBOM %s: %v", id, err))
+		http.Error(w, "Failed to encode SBOM", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", outputFormat.ContentType)
+	w.Header().Set("X-SBOM-ID", id)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// JobStatus is the lifecycle state of an SBOM generation job
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCanceled  JobStatus = "canceled"
+)
+
+const defaultJobQueueSize = 100
+
+// maxFinishedJobs caps how many finished jobs are kept for polling, whatever their age
+const maxFinishedJobs = 1000
+
+// jobPruneInterval is how often finished jobs are checked against the retention period
+const jobPruneInterval = time.Minute
+
+var (
+	// ErrJobNotFound is returned for unknown job IDs
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobQueueFull is returned when no more jobs can be queued
+	ErrJobQueueFull = errors.New("job queue is full, try again later")
+	// ErrJobFinished is returned when canceling a job that already completed
+	ErrJobFinished = errors.New("job already finished")
+)
+
+// Job tracks one SBOM generation run
+type Job struct {
+	ID         string
+	Request    SBOMRequest
+	Status     JobStatus
+	Error      string
+	Result     *SBOMResult
+	Scan       *ScanReport
+	ScanError  string
+	CreatedAt  time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	progress *ProgressStream
+}
+
+// Done is closed once the job reaches a terminal state
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// JobView is the JSON representation of a job returned by the API
+type JobView struct {
+	ID         string      `json:"id"`
+	Source     string      `json:"source"`
+	Format     string      `json:"format"`
+	Status     JobStatus   `json:"status"`
+	Error      string      `json:"error,omitempty"`
+	Result     *SBOMResult `json:"result,omitempty"`
+	Scan       *ScanReport `json:"scan,omitempty"`
+	ScanError  string      `json:"scanError,omitempty"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	StartedAt  *time.Time  `json:"startedAt,omitempty"`
+	FinishedAt *time.Time  `json:"finishedAt,omitempty"`
+}
+
+// JobManager runs SBOM generation jobs on a bounded pool of workers
+type JobManager struct {
+	mu        sync.Mutex
+	jobs      map[string]*Job
+	queue     chan *Job
+	retention time.Duration
+}
+
+// NewJobManager starts a manager that catalogs at most workers sources at once.
+// Finished jobs are forgotten once they are older than retention, 0 keeps them
+// until maxFinishedJobs newer ones have finished.
+func NewJobManager(workers int, retention time.Duration) *JobManager {
+	if workers < 1 {
+		workers = 1
+	}
+
+	m := &JobManager{
+		jobs:      make(map[string]*Job),
+		queue:     make(chan *Job, defaultJobQueueSize),
+		retention: retention,
+	}
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+	go m.pruneLoop()
+	return m
+}
+
+// Submit queues a new job for the request
+func (m *JobManager) Submit(req SBOMRequest) (*Job, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:        uuid.NewString(),
+		Request:   req,
+		Status:    JobQueued,
+		CreatedAt: time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		progress:  NewProgressStream(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case m.queue <- job:
+	default:
+		cancel()
+		return nil, ErrJobQueueFull
+	}
+	m.prune(job.CreatedAt)
+	m.jobs[job.ID] = job
+	job.progress.Step(StageQueued, ProgressCompleted, req.Source)
+
+	logger.Log(fmt.Sprintf("Queued SBOM job %s for source: %s", job.ID, req.Source))
+	return job, nil
+}
+
+// Get returns a snapshot of the job with the given ID
+func (m *JobManager) Get(id string) (JobView, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return JobView{}, ErrJobNotFound
+	}
+	return job.view(), nil
+}
+
+// Events returns the progress stream of the job with the given ID
+func (m *JobManager) Events(id string) (*ProgressStream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job.progress, nil
+}
+
+// Cancel stops a queued or running job through its context
+func (m *JobManager) Cancel(id string) (JobView, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return JobView{}, ErrJobNotFound
+	}
+
+	switch job.Status {
+	case JobQueued:
+		// The worker skips canceled jobs when it dequeues them
+		m.finish(job, JobCanceled, nil, context.Canceled)
+	case JobRunning:
+		job.cancel()
+	default:
+		return job.view(), ErrJobFinished
+	}
+
+	logger.Log(fmt.Sprintf("Canceled SBOM job %s", id))
+	return job.view(), nil
+}
+
+func (m *JobManager) worker() {
+	for job := range m.queue {
+		m.mu.Lock()
+		if job.Status != JobQueued {
+			m.mu.Unlock()
+			continue
+		}
+		job.Status = JobRunning
+		job.StartedAt = time.Now()
+		m.mu.Unlock()
+
+		m.run(job)
+	}
+}
+
+// run generates the job's SBOM and scans it, failing the job rather than the server if it panics
+func (m *JobManager) run(job *Job) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Log(fmt.Sprintf("SBOM job %s panicked: %v\n%s", job.ID, r, debug.Stack()))
+			m.mu.Lock()
+			if job.Status == JobRunning {
+				m.finish(job, JobFailed, nil, fmt.Errorf("internal error: %v", r))
+			}
+			m.mu.Unlock()
+		}
+	}()
+
+	ctx := withProgress(job.ctx, job.progress)
+	result, err := generateSBOM(ctx, job.Request)
+	var scan *ScanReport
+	var scanErr error
+	if err == nil && job.Request.Scan {
+		scan, scanErr = scanSBOM(ctx, result.SBOMID, result.File, job.Request.UseAdvanced, job.Request.ScanOptions, job.Request.Model)
+	}
+
+	// A failed scan still leaves a stored SBOM, so the result is kept and the scan error reported on its own
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case job.ctx.Err() != nil:
+		m.finish(job, JobCanceled, result, job.ctx.Err())
+	case err != nil:
+		m.finish(job, JobFailed, nil, err)
+	default:
+		job.Scan = scan
+		if scanErr != nil {
+			job.ScanError = scanErr.Error()
+			logger.Log(fmt.Sprintf("SBOM job %s scan failed: %v", job.ID, scanErr))
+		}
+		m.finish(job, JobSucceeded, result, nil)
+	}
+}
+
+// finish moves a job to a terminal state, the caller must hold m.mu
+func (m *JobManager) finish(job *Job, status JobStatus, result *SBOMResult, err error) {
+	job.Status = status
+	job.Result = result
+	job.FinishedAt = time.Now()
+	if err != nil {
+		job.Error = err.Error()
+		logger.Log(fmt.Sprintf("SBOM job %s %s: %v", job.ID, status, err))
+	}
+	message := job.Error
+	if message == "" {
+		message = job.ScanError
+	}
+	job.progress.Step(StageDone, string(status), message)
+	job.progress.Close()
+	job.progress.Trim()
+	job.cancel()
+	if job.Request.Workspace != nil {
+		job.Request.Workspace.Close()
+	}
+	close(job.done)
+}
+
+// pruneLoop periodically forgets finished jobs
+func (m *JobManager) pruneLoop() {
+	ticker := time.NewTicker(jobPruneInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mu.Lock()
+		m.prune(time.Now())
+		m.mu.Unlock()
+	}
+}
+
+// prune removes finished jobs older than the retention period and, beyond maxFinishedJobs,
+// the oldest remaining ones. The caller must hold m.mu.
+func (m *JobManager) prune(now time.Time) {
+	var finished []*Job
+	for id, job := range m.jobs {
+		if job.FinishedAt.IsZero() {
+			continue
+		}
+		if m.retention > 0 && now.Sub(job.FinishedAt) > m.retention {
+			delete(m.jobs, id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool { return finished[i].FinishedAt.Before(finished[j].FinishedAt) })
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(m.jobs, job.ID)
+	}
+}
+
+func (j *Job) view() JobView {
+	v := JobView{
+		ID:        j.ID,
+		Source:    j.Request.Source,
+		Format:    string(j.Request.Format.ID),
+		Status:    j.Status,
+		Error:     j.Error,
+		Result:    j.Result,
+		Scan:      j.Scan,
+		ScanError: j.ScanError,
+		CreatedAt: j.CreatedAt,
+	}
+	if !j.StartedAt.IsZero() {
+		startedAt := j.StartedAt
+		v.StartedAt = &startedAt
+	}
+	if !j.FinishedAt.IsZero() {
+		finishedAt := j.FinishedAt
+		v.FinishedAt = &finishedAt
+	}
+	return v
+}
+
+// Global job manager
+var jobs *JobManager
+
+// createJobHandler queues an asynchronous SBOM generation job
+func createJobHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		SBOMSource  string     `json:"sbomSource"`
+		SourceType  string     `json:"sourceType"`
+		Platform    string     `json:"platform"`
+		Git         *GitSource `json:"git"`
+		Format      string     `json:"format"`
+		Scan        bool       `json:"scan"`
+		UseAdvanced bool       `json:"useAdvanced"`
+		Model       string     `json:"model"`
+		ScanOptions
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	sourceInput, err := requestSource(body.SBOMSource, body.SourceType, body.Git)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if sourceInput == "" {
+		http.Error(w, "Error: No valid source provided. Provide an image, directory path, or remote URL.", http.StatusBadRequest)
+		return
+	}
+
+	sourceType, sourceInput, err := selectSource(sourceInput, body.SourceType, body.Platform)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	outputFormat, _, err := resolveSBOMFormat(body.Format, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := body.ScanOptions.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := jobs.Submit(SBOMRequest{
+		Source:      sourceInput,
+		SourceType:  sourceType,
+		Platform:    body.Platform,
+		Format:      outputFormat,
+		Scan:        body.Scan,
+		UseAdvanced: body.UseAdvanced,
+		ScanOptions: body.ScanOptions,
+		Model:       body.Model,
+	})
+	if err != nil {
+		logger.Log(err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	view, _ := jobs.Get(job.ID)
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(view)
+}
+
+// getJobHandler reports the status and result of a job
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	view, err := jobs.Get(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(view)
+}
+
+// cancelJobHandler cancels a queued or running job
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	view, err := jobs.Cancel(mux.Vars(r)["id"])
+	switch {
+	case errors.Is(err, ErrJobNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrJobFinished):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(view)
+}
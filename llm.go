@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/ollama"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// LLM provider names accepted in LLM_PROVIDER
+const (
+	ProviderOllama     = "ollama"
+	ProviderOpenAI     = "openai"
+	ProviderLlamaIndex = "llamaindex"
+)
+
+const llmCheckTimeout = 10 * time.Second
+
+// LLMRequest is a question for a language model about a vulnerability scan
+type LLMRequest struct {
+	Query       string
+	ScanResults string
+	SBOMData    string
+	// Model overrides the provider's configured model when set
+	Model string
+	// JSON asks the model to answer with a JSON document, for providers that support it
+	JSON bool
+	// Label names the call in streamed token events, such as the chunk and attempt
+	Label string
+	// System and History turn the request into a conversation, System grounds the
+	// answers and History holds the earlier turns ahead of Query
+	System  string
+	History []ChatMessage
+}
+
+// LLMProvider generates remediation advice with a language model
+type LLMProvider interface {
+	// Name identifies the provider in logs, responses and the scan history
+	Name() string
+	// Model returns the model a request for the given model would use
+	Model(requested string) string
+	// Available reports whether the provider can currently serve requests
+	Available(ctx context.Context) error
+	// Generate answers the request
+	Generate(ctx context.Context, req LLMRequest) (string, error)
+}
+
+// callOptions translates the request into langchaingo call options, streaming the
+// answer's tokens to the progress stream of ctx when there is one
+func callOptions(ctx context.Context, provider LLMProvider, req LLMRequest) []llms.CallOption {
+	var options []llms.CallOption
+	if req.JSON {
+		options = append(options, llms.WithJSONMode())
+	}
+	if stream := progressFrom(ctx); stream != nil {
+		name := provider.Name()
+		if req.Label != "" {
+			name += " " + req.Label
+		}
+		options = append(options, llms.WithStreamingFunc(func(_ context.Context, chunk []byte) error {
+			stream.Publish(ProgressEvent{Stage: StageToken, Status: ProgressRunning, Name: name, Message: string(chunk)})
+			return nil
+		}))
+	}
+	return options
+}
+
+// chatPrompt folds the query and scan results into a single prompt for chat models
+func chatPrompt(req LLMRequest) string {
+	return fmt.Sprintf("%s\n\nSBOM Scan:\n%s\n", req.Query, req.ScanResults)
+}
+
+// generateText sends the request to a langchaingo model, as a single prompt or as a
+// conversation when the request carries a system prompt or earlier turns
+func generateText(ctx context.Context, llm llms.Model, provider LLMProvider, req LLMRequest) (string, error) {
+	options := callOptions(ctx, provider, req)
+	if req.System == "" && len(req.History) == 0 {
+		return llms.GenerateFromSinglePrompt(ctx, llm, chatPrompt(req), options...)
+	}
+
+	system := req.System
+	if req.ScanResults != "" {
+		system += "\n\n" + req.ScanResults
+	}
+	messages := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeSystem, system)}
+	for _, m := range req.History {
+		role := llms.ChatMessageTypeHuman
+		if m.Role == ChatRoleAssistant {
+			role = llms.ChatMessageTypeAI
+		}
+		messages = append(messages, llms.TextParts(role, m.Content))
+	}
+	messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, req.Query))
+
+	resp, err := llm.GenerateContent(ctx, messages, options...)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", errors.New("the model returned no answer")
+	}
+	return resp.Choices[0].Content, nil
+}
+
+// newLLMProvider creates the provider with the given name from the application config
+func newLLMProvider(name string) (LLMProvider, error) {
+	switch strings.ToLower(name) {
+	case ProviderOllama:
+		return &OllamaProvider{Host: appConfig.OllamaHost, DefaultModel: appConfig.DefaultModel}, nil
+	case ProviderOpenAI:
+		if appConfig.OpenAIBaseURL == "" {
+			return nil, fmt.Errorf("BASE_URL is required for the %s provider", ProviderOpenAI)
+		}
+		return &OpenAIProvider{BaseURL: appConfig.OpenAIBaseURL, APIKey: appConfig.OpenAIAPIKey, DefaultModel: appConfig.OpenAIModel}, nil
+	case ProviderLlamaIndex:
+		return &LlamaIndexProvider{Client: NewLlamaIndexClient(appConfig.LlamaIndexEndpoint)}, nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q, allowed values are %s, %s, %s", name, ProviderOllama, ProviderOpenAI, ProviderLlamaIndex)
+	}
+}
+
+// OllamaProvider talks to an Ollama server
+type OllamaProvider struct {
+	Host         string
+	DefaultModel string
+}
+
+// Name implements LLMProvider
+func (p *OllamaProvider) Name() string { return ProviderOllama }
+
+// Model implements LLMProvider
+func (p *OllamaProvider) Model(requested string) string {
+	if requested != "" {
+		return requested
+	}
+	return p.DefaultModel
+}
+
+// Available checks that the server is up and the default model is installed
+func (p *OllamaProvider) Available(ctx context.Context) error {
+	payloadBytes, err := json.Marshal(map[string]string{"model": p.DefaultModel})
+	if err != nil {
+		return fmt.Errorf("failed to create test payload: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, llmCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(p.Host, "/")+"/api/show", bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("ollama service error (status %d): %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// Generate implements LLMProvider
+func (p *OllamaProvider) Generate(ctx context.Context, req LLMRequest) (string, error) {
+	model := p.Model(req.Model)
+	logger.Log(fmt.Sprintf("Using Ollama model: %s", model))
+
+	llm, err := ollama.New(
+		ollama.WithModel(model),
+		ollama.WithServerURL(p.Host),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to initialize Ollama client: %w", err)
+	}
+
+	response, err := generateText(ctx, llm, p, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get response from Ollama model %s: %w", model, err)
+	}
+	return response, nil
+}
+
+// OpenAIProvider talks to any OpenAI-compatible chat completions server,
+// such as Docker Model Runner, llama.cpp or vLLM
+type OpenAIProvider struct {
+	BaseURL      string
+	APIKey       string
+	DefaultModel string
+}
+
+// Name implements LLMProvider
+func (p *OpenAIProvider) Name() string { return ProviderOpenAI }
+
+// Model implements LLMProvider
+func (p *OpenAIProvider) Model(requested string) string {
+	if requested != "" {
+		return requested
+	}
+	return p.DefaultModel
+}
+
+// token returns the API key, local servers accept any value but the client requires one
+func (p *OpenAIProvider) token() string {
+	if p.APIKey == "" {
+		return "none"
+	}
+	return p.APIKey
+}
+
+// Available checks that the server answers its model listing
+func (p *OpenAIProvider) Available(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, llmCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(p.BaseURL, "/")+"/models", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", p.BaseURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("OpenAI-compatible service error (status %d): %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// Generate implements LLMProvider
+func (p *OpenAIProvider) Generate(ctx context.Context, req LLMRequest) (string, error) {
+	model := p.Model(req.Model)
+	logger.Log(fmt.Sprintf("Using OpenAI-compatible model %s at %s", model, p.BaseURL))
+
+	llm, err := openai.New(
+		openai.WithBaseURL(strings.TrimSuffix(p.BaseURL, "/")),
+		openai.WithToken(p.token()),
+		openai.WithModel(model),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to initialize OpenAI-compatible client: %w", err)
+	}
+
+	response, err := generateText(ctx, llm, p, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get response from model %s: %w", model, err)
+	}
+	return response, nil
+}
+
+// LlamaIndexProvider sends the scan and SBOM to the LlamaIndex service, which picks its own model
+type LlamaIndexProvider struct {
+	Client *LlamaIndexClient
+}
+
+// Name implements LLMProvider
+func (p *LlamaIndexProvider) Name() string { return ProviderLlamaIndex }
+
+// Model implements LLMProvider, the service doesn't expose a model choice
+func (p *LlamaIndexProvider) Model(_ string) string { return "" }
+
+// Available implements LLMProvider, failures surface from Generate instead
+func (p *LlamaIndexProvider) Available(_ context.Context) error { return nil }
+
+// Generate implements LLMProvider, conversations are folded into the query as the service takes a single question
+func (p *LlamaIndexProvider) Generate(ctx context.Context, req LLMRequest) (string, error) {
+	query := req.Query
+	if req.System != "" || len(req.History) > 0 {
+		var b strings.Builder
+		b.WriteString(req.System)
+		for _, m := range req.History {
+			fmt.Fprintf(&b, "\n\n%s: %s", m.Role, m.Content)
+		}
+		fmt.Fprintf(&b, "\n\n%s: %s", ChatRoleUser, req.Query)
+		query = b.String()
+	}
+	return p.Client.Query(ctx, query, req.ScanResults, req.SBOMData)
+}
+
+// Global LLM providers, the configured one and LlamaIndex for advanced analysis
+var (
+	llmProvider        LLMProvider
+	llamaIndexProvider LLMProvider
+)
@@ -18,26 +18,38 @@ import (
 
 	"github.com/anchore/go-collections"
 	"github.com/anchore/stereoscope"
+	"github.com/anchore/stereoscope/pkg/image"
 	"github.com/anchore/syft/syft"
 	"github.com/anchore/syft/syft/cataloging/pkgcataloging"
-	"github.com/anchore/syft/syft/format/cyclonedxjson"
 	"github.com/anchore/syft/syft/sbom"
 	"github.com/anchore/syft/syft/source"
 	"github.com/anchore/syft/syft/source/sourceproviders"
 	"github.com/gorilla/mux"
-	"github.com/tmc/langchaingo/llms/ollama"
 )
 
 // Constants for better maintainability
 const (
-	contentTypeJSON       = "application/json"
-	contentTypeTextPlain  = "text/plain"
-	defaultSBOMOutputFile = "sbom.cyclonedx.json"
-	defaultLogFile        = "static/output.log"
-	defaultLlamaIndexHost = "http://llama-index-api:8000"
-	defaultOllamaHost     = "http://host.docker.internal:11434"
-	defaultModel          = "mistral"
-	gitCloneDir           = "/tmp/git-sbom"
+	contentTypeJSON          = "application/json"
+	contentTypeTextPlain     = "text/plain"
+	defaultSBOMDir           = "sboms"
+	defaultDatabaseFile      = "sboms/sbom-api.db"
+	defaultGrypeDBDir        = "grype-db"
+	defaultScanConfigFile    = "scan-config.yaml"
+	defaultPolicyFile        = "policy.yaml"
+	defaultWorkspaceDir      = "/tmp/syft-api-workspaces"
+	defaultLogFile           = "static/output.log"
+	defaultLlamaIndexHost    = "http://llama-index-api:8000"
+	defaultOllamaHost        = "http://host.docker.internal:11434"
+	defaultModel             = "mistral"
+	defaultLLMProvider       = ProviderOllama
+	defaultMaxConcurrentJobs = 2
+	defaultJobRetention      = 60
+	defaultLLMContextTokens  = 4096
+	defaultLLMConcurrency    = 2
+	defaultWorkspaceQuotaMB  = 2048
+	defaultUploadMaxMB       = 1024
+	defaultCloneTimeout      = 300
+	defaultGrypeDBUpdate     = 60
 )
 
 // Configuration struct for application settings
@@ -45,8 +57,29 @@ type Config struct {
 	LlamaIndexEndpoint string
 	OllamaHost         string
 	DefaultModel       string
+	LLMProvider        string
+	OpenAIBaseURL      string
+	OpenAIModel        string
+	OpenAIAPIKey       string
+	LLMContextTokens   int
+	LLMConcurrency     int
 	LogFile            string
-	SBOMOutputFile     string
+	SBOMDir            string
+	DatabaseFile       string
+	MaxConcurrentJobs  int
+	GrypeDBDir         string
+	GrypeDBAutoUpdate  bool
+	ScanConfigFile     string
+	PolicyFile         string
+	WorkspaceDir       string
+	WorkspaceQuotaMB   int
+	UploadMaxMB        int
+	// CloneTimeout is in seconds
+	CloneTimeout int
+	// JobRetention is in minutes
+	JobRetention int
+	// GrypeDBUpdateEvery is in minutes
+	GrypeDBUpdateEvery int
 }
 
 // Global configuration with defaults
@@ -54,8 +87,26 @@ var appConfig = Config{
 	LlamaIndexEndpoint: getEnv("LLAMA_INDEX_ENDPOINT", defaultLlamaIndexHost),
 	OllamaHost:         getEnv("OLLAMA_HOST", defaultOllamaHost),
 	DefaultModel:       getEnv("DEFAULT_MODEL", defaultModel),
+	LLMProvider:        getEnv("LLM_PROVIDER", defaultLLMProvider),
+	OpenAIBaseURL:      getEnv("BASE_URL", ""),
+	OpenAIModel:        getEnv("MODEL", defaultModel),
+	OpenAIAPIKey:       getEnv("API_KEY", ""),
+	LLMContextTokens:   getEnvInt("LLM_CONTEXT_TOKENS", defaultLLMContextTokens),
+	LLMConcurrency:     getEnvInt("LLM_CONCURRENCY", defaultLLMConcurrency),
 	LogFile:            defaultLogFile,
-	SBOMOutputFile:     defaultSBOMOutputFile,
+	SBOMDir:            getEnv("SBOM_DIR", defaultSBOMDir),
+	DatabaseFile:       getEnv("DATABASE_FILE", defaultDatabaseFile),
+	MaxConcurrentJobs:  getEnvInt("MAX_CONCURRENT_JOBS", defaultMaxConcurrentJobs),
+	JobRetention:       getEnvInt("JOB_RETENTION_MINUTES", defaultJobRetention),
+	GrypeDBDir:         getEnv("GRYPE_DB_DIR", defaultGrypeDBDir),
+	GrypeDBAutoUpdate:  getEnvBool("GRYPE_DB_AUTO_UPDATE", true),
+	GrypeDBUpdateEvery: getEnvInt("GRYPE_DB_UPDATE_INTERVAL_MINUTES", defaultGrypeDBUpdate),
+	ScanConfigFile:     getEnv("SCAN_CONFIG_FILE", defaultScanConfigFile),
+	PolicyFile:         getEnv("POLICY_FILE", defaultPolicyFile),
+	WorkspaceDir:       getEnv("WORKSPACE_DIR", defaultWorkspaceDir),
+	WorkspaceQuotaMB:   getEnvInt("WORKSPACE_QUOTA_MB", defaultWorkspaceQuotaMB),
+	UploadMaxMB:        getEnvInt("UPLOAD_MAX_MB", defaultUploadMaxMB),
+	CloneTimeout:       getEnvInt("CLONE_TIMEOUT", defaultCloneTimeout),
 }
 
 // Helper function to get environment variable with default
@@ -67,6 +118,24 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+// Helper function to get an integer environment variable with default
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// Helper function to get a boolean environment variable with default
+func getEnvBool(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 // LlamaIndexClient handles interactions with the LlamaIndex API
 type LlamaIndexClient struct {
 	BaseURL string
@@ -79,10 +148,10 @@ func NewLlamaIndexClient(baseURL string) *LlamaIndexClient {
 	}
 }
 
-// AnalyzeVulnerabilities sends vulnerability data to LlamaIndex for enhanced analysis
-func (c *LlamaIndexClient) AnalyzeVulnerabilities(scanResults string, sbomData string) (string, error) {
+// Query sends a question with the vulnerability data to LlamaIndex for enhanced analysis
+func (c *LlamaIndexClient) Query(ctx context.Context, query string, scanResults string, sbomData string) (string, error) {
 	payload := map[string]interface{}{
-		"query": "Analyze these vulnerabilities and provide a comprehensive remediation plan",
+		"query": query,
 		"data": map[string]string{
 			"scan_results": scanResults,
 			"sbom_data":    sbomData,
@@ -94,7 +163,13 @@ func (c *LlamaIndexClient) AnalyzeVulnerabilities(scanResults string, sbomData s
 		return "", fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	resp, err := http.Post(c.BaseURL+"/query", contentTypeJSON, bytes.NewBuffer(payloadBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/query", bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to call LlamaIndex API: %w", err)
 	}
@@ -162,12 +237,18 @@ func extractScriptBlock(text string) string {
 	if start == -1 {
 		return ""
 	}
+	// Skip the info string after the fence, such as "bash" or "sh"
 	rest := text[start+3:]
+	newline := strings.Index(rest, "\n")
+	if newline == -1 {
+		return ""
+	}
+	rest = rest[newline+1:]
 	end := strings.Index(rest, "```")
 	if end == -1 {
 		return ""
 	}
-	return strings.TrimSpace(rest[5:end])
+	return strings.TrimSpace(rest[:end])
 }
 
 // Global logger
@@ -182,22 +263,85 @@ func main() {
 	}
 	defer logger.Close()
 
+	artifacts, err = NewArtifactStore(appConfig.SBOMDir)
+	if err != nil {
+		fmt.Printf("Failed to initialize SBOM store: %v\n", err)
+		os.Exit(1)
+	}
+
+	workspaces, err = NewWorkspaceManager(appConfig.WorkspaceDir, int64(appConfig.WorkspaceQuotaMB)<<20, time.Duration(appConfig.CloneTimeout)*time.Second)
+	if err != nil {
+		fmt.Printf("Failed to initialize workspaces: %v\n", err)
+		os.Exit(1)
+	}
+
+	store, err = NewStore(appConfig.DatabaseFile)
+	if err != nil {
+		fmt.Printf("Failed to initialize database: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	matcher, err = NewVulnerabilityMatcher(appConfig.GrypeDBDir, appConfig.GrypeDBAutoUpdate, time.Duration(appConfig.GrypeDBUpdateEvery)*time.Minute)
+	if err != nil {
+		fmt.Printf("Failed to initialize vulnerability matcher: %v\n", err)
+		os.Exit(1)
+	}
+
+	llmProvider, err = newLLMProvider(appConfig.LLMProvider)
+	if err != nil {
+		fmt.Printf("Failed to initialize LLM provider: %v\n", err)
+		os.Exit(1)
+	}
+	llamaIndexProvider, _ = newLLMProvider(ProviderLlamaIndex)
+
+	scanConfig, err = loadScanConfig(appConfig.ScanConfigFile)
+	if err != nil {
+		fmt.Printf("Failed to load scan config: %v\n", err)
+		os.Exit(1)
+	}
+
+	policy, err = loadPolicy(appConfig.PolicyFile)
+	if err != nil {
+		fmt.Printf("Failed to load policy: %v\n", err)
+		os.Exit(1)
+	}
+
+	progressRouter = NewProgressRouter()
+	jobs = NewJobManager(appConfig.MaxConcurrentJobs, time.Duration(appConfig.JobRetention)*time.Minute)
+
 	r := mux.NewRouter()
 
 	// Add CORS middleware
 	r.Use(corsMiddleware)
 
-	// Serve static files
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static"))).Methods("GET")
-	fmt.Println("Serving static files from ./static")
-
 	// API routes
 	r.HandleFunc("/generate-sbom", generateSBOMHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/upload", uploadHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/scan-sbom", scanSBOMHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/logs", logsHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/remediate", remediateHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/llamaindex-analyze", llamaIndexAnalyzeHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/health", healthCheckHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/jobs", createJobHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/jobs/{id}", getJobHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/jobs/{id}", cancelJobHandler).Methods("DELETE")
+	r.HandleFunc("/jobs/{id}/events", jobEventsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/sboms", listSBOMsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/sboms/import", importSBOMHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/sboms/{id}", getSBOMHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/sboms/{id}", deleteSBOMHandler).Methods("DELETE")
+	r.HandleFunc("/sboms/{id}/export", exportSBOMHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/history", historyHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/sboms/{a}/diff/{b}", diffSBOMsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/sboms/{id}/policy", evaluatePolicyHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/sboms/{id}/patch", sbomPatchHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/sboms/{id}/chat", chatHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/sboms/{id}/chat/{session}", getChatHandler).Methods("GET", "OPTIONS")
+
+	// Serve static files, registered last so it doesn't shadow GET API routes
+	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static"))).Methods("GET")
+	fmt.Println("Serving static files from ./static")
 
 	port := getEnv("PORT", "3000")
 	fmt.Printf("API is running at http://localhost:%s\n", port)
@@ -228,13 +372,53 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 		"status":        "healthy",
 		"llamaIndexAPI": appConfig.LlamaIndexEndpoint,
 		"ollamaHost":    appConfig.OllamaHost,
+		"llmProvider":   llmProvider.Name(),
+		"llmModel":      llmProvider.Model(""),
 		"version":       "1.0.0",
 	})
 }
 
+// SBOMRequest describes what to catalog and how to encode the result
+type SBOMRequest struct {
+	Source string
+	// SourceType is the syft source tag or git that Source is read as, guessed when empty
+	SourceType string
+	// Platform selects one image of a multi-arch manifest, such as linux/arm64
+	Platform string
+	// SourceInput is a syft source input such as docker-archive:/path, used as is instead of resolving Source
+	SourceInput string
+	// SourceName names the source in the SBOM instead of the path SourceInput refers to
+	SourceName string
+	// Workspace holds the files SourceInput refers to, removed when the job finishes
+	Workspace *Workspace
+	Format    SBOMFormat
+	// Scan runs the vulnerability scan and remediation once the SBOM is stored
+	Scan        bool
+	UseAdvanced bool
+	ScanOptions ScanOptions
+	// Model overrides the LLM provider's model for remediation
+	Model string
+}
+
+// SBOMResult is a generated SBOM stored in the artifact store
+type SBOMResult struct {
+	SBOMID      string `json:"sbomId"`
+	File        string `json:"file"`
+	Format      string `json:"format"`
+	FormatID    string `json:"formatId"`
+	ContentType string `json:"contentType"`
+	// GitCommit is the commit cataloged for git sources
+	GitCommit string `json:"gitCommit,omitempty"`
+	SBOMData  string `json:"sbomData"`
+}
+
 func generateSBOMHandler(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		SBOMSource string `json:"sbomSource"`
+		SBOMSource string     `json:"sbomSource"`
+		SourceType string     `json:"sourceType"`
+		Platform   string     `json:"platform"`
+		Git        *GitSource `json:"git"`
+		Format     string     `json:"format"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -242,93 +426,235 @@ func generateSBOMHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	source := body.SBOMSource
+	sourceInput, err := requestSource(body.SBOMSource, body.SourceType, body.Git)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	outputFormat, negotiated, err := resolveSBOMFormat(body.Format, r.Header.Get("Accept"))
+	if err != nil {
+		logger.Log(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if source == "" {
+	if sourceInput == "" {
 		msg := "Error: No valid source provided. Provide an image, directory path, or remote URL."
 		logger.Log(msg)
 		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
 
-	sourceInput, err := determineSourceInput(source)
+	sourceType, sourceInput, err := selectSource(sourceInput, body.SourceType, body.Platform)
 	if err != nil {
 		logger.Log(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Run through the job pool so synchronous requests count against the same limit
+	job, err := jobs.Submit(SBOMRequest{Source: sourceInput, SourceType: sourceType, Platform: body.Platform, Format: outputFormat})
+	if err != nil {
+		logger.Log(err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	serveJobSBOM(w, r, job, negotiated)
+}
+
+// serveJobSBOM waits for a generation job and responds with its SBOM, as the document itself when
+// the client negotiated an SBOM media type. The job is canceled if the client goes away.
+func serveJobSBOM(w http.ResponseWriter, r *http.Request, job *Job, negotiated bool) {
+	select {
+	case <-job.Done():
+	case <-r.Context().Done():
+		// Client went away, stop cataloging
+		jobs.Cancel(job.ID)
+		return
+	}
+
+	view, err := jobs.Get(job.ID)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if view.Status != JobSucceeded {
+		http.Error(w, view.Error, http.StatusInternalServerError)
+		return
+	}
+	result := view.Result
+
+	// Clients that negotiated an SBOM media type get the document itself
+	if negotiated {
+		w.Header().Set("Content-Type", result.ContentType)
+		w.Header().Set("X-SBOM-ID", result.SBOMID)
+		w.Write([]byte(result.SBOMData))
+		return
+	}
+
+	response := map[string]interface{}{
+		"message":     "SBOM generated successfully",
+		"jobId":       job.ID,
+		"sbomId":      result.SBOMID,
+		"format":      result.Format,
+		"formatId":    result.FormatID,
+		"contentType": result.ContentType,
+		"file":        result.File,
+		"sbomData":    result.SBOMData,
+	}
+	if result.GitCommit != "" {
+		response["gitCommit"] = result.GitCommit
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(response)
+}
+
+// generateSBOM catalogs the requested source and stores the encoded SBOM.
+// Cataloging stops early when ctx is canceled.
+func generateSBOM(ctx context.Context, req SBOMRequest) (*SBOMResult, error) {
+	stream := progressFrom(ctx)
+	stream.Step(StageSource, ProgressStarted, req.Source)
+
+	sourceInput := req.SourceInput
+	var checkout *GitCheckout
+	if sourceInput == "" {
+		var err error
+		sourceInput, checkout, err = determineSourceInput(ctx, req.Source, req.SourceType)
+		if err != nil {
+			stream.Step(StageSource, ProgressFailed, err.Error())
+			return nil, err
+		}
+	}
+	// Git sources are recorded pinned to the cataloged commit, which is also the SBOM's source version
+	recordedSource, alias := req.Source, source.Alias{Name: req.SourceName}
+	// Sources read as a type guessing wouldn't pick keep it, such as registry:alpine
+	if guessed, _ := guessSourceType(req.Source); req.SourceType != "" && req.SourceType != guessed {
+		recordedSource = req.SourceType + ":" + req.Source
+	}
+	if checkout != nil {
+		defer checkout.Close()
+		recordedSource = checkout.Source.String()
+		alias = checkout.Alias()
+	}
 
 	logger.Log(fmt.Sprintf("Processing SBOM for source: %s", sourceInput))
 
+	// Forward library bus events to this job while it catalogs
+	untrack := progressRouter.Track(stream)
+	defer untrack()
+
+	src, err := openSource(ctx, sourceInput, alias, req.Platform)
+	if err != nil {
+		stream.Step(StageSource, ProgressFailed, err.Error())
+		return nil, err
+	}
+	defer src.Close()
+	stream.Step(StageSource, ProgressCompleted, sourceInput)
+
+	sbomData, err := syft.CreateSBOM(ctx, src, catalogConfig())
+	if err != nil {
+		stream.Step(StageCataloging, ProgressFailed, err.Error())
+		return nil, fmt.Errorf("failed to create SBOM: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	untrack()
+	reportPackageCounts(stream, sbomData)
+
+	// Save SBOM under its own ID so concurrent requests don't overwrite each other
+	stream.Step(StageEncoding, ProgressStarted, req.Format.Name)
+	sbomID, sbomFile, err := artifacts.Save(sbomData, req.Format)
+	if err != nil {
+		stream.Step(StageEncoding, ProgressFailed, err.Error())
+		return nil, fmt.Errorf("failed to save SBOM to file: %w", err)
+	}
+	stream.Step(StageEncoding, ProgressCompleted, sbomID)
+
+	// Read SBOM content for response
+	sbomContent, err := os.ReadFile(sbomFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read generated SBOM file: %w", err)
+	}
+
+	if err := store.SaveSBOM(ctx, newSBOMRecord(sbomID, recordedSource, sbomFile, req.Format, sbomData, sbomContent)); err != nil {
+		return nil, err
+	}
+
+	logger.Log(fmt.Sprintf("SBOM %s generated successfully in %s format.", sbomID, req.Format.ID))
+
+	return &SBOMResult{
+		SBOMID:      sbomID,
+		File:        sbomFile,
+		Format:      req.Format.Name,
+		FormatID:    string(req.Format.ID),
+		ContentType: req.Format.ContentType,
+		GitCommit:   alias.Version,
+		SBOMData:    string(sbomContent),
+	}, nil
+}
+
+// openSource resolves a source input such as "dir:/path" or "image:name" with syft,
+// platform picks the image of a multi-arch manifest
+func openSource(ctx context.Context, sourceInput string, alias source.Alias, platform string) (source.Source, error) {
 	schemeSource, newUserInput := stereoscope.ExtractSchemeSource(sourceInput, allSourceTags()...)
 	getSourceCfg := syft.DefaultGetSourceConfig()
+	if !alias.IsEmpty() {
+		getSourceCfg = getSourceCfg.WithAlias(alias)
+	}
+	if platform != "" {
+		p, err := image.NewPlatform(platform)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get source: %w", err)
+		}
+		getSourceCfg = getSourceCfg.WithPlatform(p)
+	}
 	if schemeSource != "" {
 		getSourceCfg = getSourceCfg.WithSources(schemeSource)
 		sourceInput = newUserInput
 	}
 
-	src, err := syft.GetSource(context.Background(), sourceInput, getSourceCfg)
+	src, err := syft.GetSource(ctx, sourceInput, getSourceCfg)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to get source: %v", err)
-		logger.Log(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("failed to get source: %w", err)
 	}
+	return src, nil
+}
 
-	cfg := syft.DefaultCreateSBOMConfig().WithCatalogerSelection(
+// catalogConfig selects the catalogers used for every SBOM
+func catalogConfig() *syft.CreateSBOMConfig {
+	return syft.DefaultCreateSBOMConfig().WithCatalogerSelection(
 		pkgcataloging.NewSelectionRequest().WithDefaults(
 			pkgcataloging.InstalledTag,
 			pkgcataloging.DirectoryTag,
 			pkgcataloging.ImageTag,
 		),
 	)
-	sbomData, err := syft.CreateSBOM(context.Background(), src, cfg)
-	if err != nil {
-		msg := fmt.Sprintf("Failed to create SBOM: %v", err)
-		logger.Log(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
-		return
-	}
+}
 
-	// Save SBOM to file
-	saveErr := saveSBOMToFile(sbomData, appConfig.SBOMOutputFile)
-	if saveErr != nil {
-		logger.Log(fmt.Sprintf("Failed to save SBOM to file: %v", err))
-		http.Error(w, "Failed to save SBOM to file", http.StatusInternalServerError)
-		return
+// determineSourceInput turns a requested source of the given type into a syft source input,
+// cloning git sources into a checkout the caller must close. An empty type is guessed.
+func determineSourceInput(ctx context.Context, source string, sourceType string) (string, *GitCheckout, error) {
+	if sourceType == "" {
+		sourceType, source = guessSourceType(source)
+	}
+	if sourceType != gitSourceType {
+		return sourceType + ":" + source, nil, nil
 	}
 
-	// Read SBOM content for response
-	sbomContent, err := os.ReadFile(appConfig.SBOMOutputFile)
+	spec, err := parseGitSource(source)
 	if err != nil {
-		msg := "Failed to read generated SBOM file."
-		logger.Log(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
-		return
+		return "", nil, err
 	}
-
-	logger.Log("SBOM generated successfully.")
-
-	w.Header().Set("Content-Type", contentTypeJSON)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":  "SBOM generated successfully",
-		"format":   "CycloneDX JSON",
-		"file":     appConfig.SBOMOutputFile,
-		"sbomData": string(sbomContent),
-	})
-}
-
-func determineSourceInput(source string) (string, error) {
-	if _, err := os.Stat(source); err == nil {
-		return "dir:" + source, nil
-	} else if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
-		if err := cloneGitRepo(source, gitCloneDir); err != nil {
-			return "", fmt.Errorf("failed to clone repository: %w", err)
-		}
-		return "dir:" + gitCloneDir, nil
-	} else {
-		return "image:" + source, nil
+	if spec == nil {
+		return "", nil, fmt.Errorf("%s is not a git URL", source)
+	}
+	checkout, err := checkoutGitSource(ctx, *spec)
+	if err != nil {
+		return "", nil, err
 	}
+	return "dir:" + checkout.Dir, checkout, nil
 }
 
 // getQualityScore calculates the quality score of an SBOM using the sbomqs tool
@@ -398,8 +724,12 @@ func getQualityScore(sbomFile string) (map[string]interface{}, error) {
 
 func scanSBOMHandler(w http.ResponseWriter, r *http.Request) {
 	var body struct {
+		SBOMID      string `json:"sbomId"`
 		SBOMFile    string `json:"sbomFile"`
 		UseAdvanced bool   `json:"useAdvanced"`
+		IncludeRaw  bool   `json:"includeRaw"`
+		Model       string `json:"model"`
+		ScanOptions
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -408,176 +738,270 @@ func scanSBOMHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sbomFile := body.SBOMFile
-	if sbomFile == "" {
-		sbomFile = appConfig.SBOMOutputFile
+	if err := body.ScanOptions.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if _, err := os.Stat(sbomFile); os.IsNotExist(err) {
-		http.Error(w, "SBOM file not found. Please generate it first.", http.StatusBadRequest)
+	// A scan of a stored file is recorded under the ID the file is stored as
+	sbomID, sbomFile, err := resolveSBOMFile(body.SBOMID, body.SBOMFile)
+	if err != nil {
+		http.Error(w, err.Error(), sbomLookupStatus(err))
 		return
 	}
 
-	logger.Log("Starting SBOM scan...")
+	run := func(ctx context.Context) (interface{}, error) {
+		report, err := scanSBOM(ctx, sbomID, sbomFile, body.UseAdvanced, body.ScanOptions, body.Model)
+		if err != nil {
+			logger.Log(fmt.Sprintf("Error running Grype: %v", err))
+			return nil, err
+		}
+		return scanResponse(sbomID, report, body.IncludeRaw), nil
+	}
+	if wantsStream(r) {
+		serveStream(w, r, run)
+		return
+	}
 
-	scanOutput, err := runGrypeScan(sbomFile)
+	response, err := run(r.Context())
 	if err != nil {
-		logger.Log(fmt.Sprintf("Error running Grype: %v", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(response)
+}
 
-	if len(scanOutput) == 0 {
-		http.Error(w, "No vulnerabilities found", http.StatusOK)
-		return
+// scanResponse is the /scan-sbom response body for a report
+func scanResponse(sbomID string, report *ScanReport, includeRaw bool) map[string]interface{} {
+	if len(report.Vulnerabilities) == 0 {
+		return map[string]interface{}{
+			"message":         "No vulnerabilities found",
+			"sbomId":          sbomID,
+			"vulnerabilities": []VulnerabilityMatch{},
+			"severitySummary": report.SeveritySummary,
+			"ignored":         report.Ignored,
+		}
+	}
+
+	if report.RemediationWarning != "" {
+		// Still return the scan results without remediation
+		response := map[string]interface{}{
+			"sbomId":             sbomID,
+			"vulnerabilities":    report.Vulnerabilities,
+			"severitySummary":    report.SeveritySummary,
+			"ignored":            report.Ignored,
+			"remediationScript":  "",
+			"remediationWarning": report.RemediationWarning,
+			"remediationPlan":    report.RemediationPlan,
+			"qualityScore":       report.QualityScore,
+		}
+		// The raw table is only returned on request, clients should use the structured results
+		if includeRaw {
+			response["scanResult"] = report.ScanResult
+		}
+		return response
+	}
+
+	response := map[string]interface{}{
+		"message":             "Grype scan and remediation completed successfully",
+		"sbomId":              sbomID,
+		"vulnerabilities":     report.Vulnerabilities,
+		"severitySummary":     report.SeveritySummary,
+		"ignored":             report.Ignored,
+		"remediationScript":   report.RemediationScript,
+		"remediationCommands": report.RemediationCommands,
+		"remediationPlan":     report.RemediationPlan,
+		"pkgType":             report.PkgType,
+		"markdownResponse":    fmt.Sprintf("```bash\n%s\n```", report.RemediationCommands),
+		"engine":              report.Engine,
+		"model":               report.Model,
+		"ollamaModel":         report.Model,
+		"ollamaRawResponse":   report.RemediationScript,
+		"usedLlamaIndex":      report.Engine == ProviderLlamaIndex,
+		"scriptSafety":        report.ScriptSafety,
+		"advice":              report.Advice,
+		"fallbackReason":      report.FallbackReason,
+		"qualityScore":        report.QualityScore,
+	}
+	if includeRaw {
+		response["scanResult"] = report.ScanResult
+	}
+	return response
+}
+
+// ScanReport is the outcome of scanning a stored SBOM and generating remediation
+type ScanReport struct {
+	ScanResult          string                 `json:"scanResult"`
+	Vulnerabilities     []VulnerabilityMatch   `json:"vulnerabilities,omitempty"`
+	SeveritySummary     map[string]int         `json:"severitySummary"`
+	Ignored             []IgnoredMatch         `json:"ignored,omitempty"`
+	PkgType             string                 `json:"pkgType,omitempty"`
+	QualityScore        map[string]interface{} `json:"qualityScore,omitempty"`
+	RemediationScript   string                 `json:"remediationScript"`
+	RemediationCommands string                 `json:"remediationCommands"`
+	RemediationWarning  string                 `json:"remediationWarning,omitempty"`
+	// RemediationPlan is the pinned upgrade for each vulnerable package grouped by ecosystem and manifest, independent of the LLM
+	RemediationPlan []RemediationGroup `json:"remediationPlan,omitempty"`
+	// Engine and Model identify what generated the remediation, the engine is "basic" without an LLM
+	Engine string `json:"engine,omitempty"`
+	Model  string `json:"model,omitempty"`
+	// ScriptSafety annotates each command of the remediation script with its risk
+	ScriptSafety *ScriptAssessment `json:"scriptSafety,omitempty"`
+	// Advice is the LLM's structured remediation the script was rendered from
+	Advice         *RemediationAdvice `json:"advice,omitempty"`
+	FallbackReason string             `json:"fallbackReason,omitempty"`
+}
+
+// scanSBOM runs the vulnerability scan, quality scoring and remediation for an SBOM file.
+// Remediation failures are reported in the warning field rather than as an error.
+// Reports for stored SBOMs are recorded in the history.
+func scanSBOM(ctx context.Context, sbomID string, sbomFile string, useAdvanced bool, opts ScanOptions, model string) (*ScanReport, error) {
+	stream := progressFrom(ctx)
+	logger.Log("Starting SBOM scan...")
+
+	stream.Step(StageScan, ProgressStarted, "matching vulnerabilities")
+	matches, ignored, err := scanMatches(ctx, sbomFile, opts)
+	if err != nil {
+		stream.Step(StageScan, ProgressFailed, err.Error())
+		return nil, err
 	}
+	stream.Step(StageScan, ProgressCompleted, fmt.Sprintf("%d vulnerabilities found, %d ignored", len(matches), len(ignored)))
+
+	if len(matches) == 0 {
+		report := &ScanReport{Vulnerabilities: matches, SeveritySummary: summarizeSeverities(matches), Ignored: ignored}
+		recordScan(ctx, sbomID, report, "")
+		return report, nil
+	}
+	scanOutput := formatMatchTable(matches)
 
 	// Extract SBOM content for advanced analysis
-	sbomContent, err := os.ReadFile(appConfig.SBOMOutputFile)
+	sbomContent, err := os.ReadFile(sbomFile)
 	if err != nil {
 		logger.Log(fmt.Sprintf("Error reading SBOM file: %v", err))
-		http.Error(w, fmt.Sprintf("Error reading SBOM file: %v", err), http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error reading SBOM file: %w", err)
 	}
 
-	pkgType := detectPackageType(scanOutput)
-	logger.Log(fmt.Sprintf("Detected package type: %s", pkgType))
+	plan := planRemediation(matches)
+	pkgType := packageTypeLabels(plan)
+	logger.Log(fmt.Sprintf("Detected package types: %s", pkgType))
 
 	// Calculate SBOM quality score
+	stream.Step(StageQuality, ProgressStarted, "")
 	qualityScore, scoreErr := getQualityScore(sbomFile)
 	if scoreErr != nil {
 		logger.Log(fmt.Sprintf("Warning: Error calculating quality score: %v", scoreErr))
 		// Continue with scan - quality score is optional
 	}
+	stream.Step(StageQuality, ProgressCompleted, "")
 
-	remediation, err := getRemediation(scanOutput, pkgType, body.UseAdvanced, string(sbomContent))
+	report := &ScanReport{
+		ScanResult:      scanOutput,
+		Vulnerabilities: matches,
+		SeveritySummary: summarizeSeverities(matches),
+		Ignored:         ignored,
+		PkgType:         pkgType,
+		QualityScore:    qualityScore,
+		RemediationPlan: plan,
+	}
+
+	stream.Step(StageRemediation, ProgressStarted, "")
+	remediation, err := getRemediation(ctx, matches, plan, useAdvanced, string(sbomContent), model)
 	if err != nil {
 		// Don't fail completely, just log the error and proceed with basic scan results
 		logger.Log(fmt.Sprintf("Warning: Could not get remediation script: %v", err))
-		remediationError := fmt.Sprintf("Could not generate remediation script: %v", err)
-
-		// Still return the scan results without remediation
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"scanResult":         scanOutput,
-			"remediationScript":  "",
-			"remediationWarning": remediationError,
-			"qualityScore":       qualityScore,
-		})
-		return
+		report.RemediationWarning = fmt.Sprintf("Could not generate remediation script: %v", err)
+		stream.Step(StageRemediation, ProgressFailed, report.RemediationWarning)
+		recordScan(ctx, sbomID, report, "")
+		return report, nil
 	}
+	stream.Step(StageRemediation, ProgressCompleted, "")
 
 	logger.Log("SBOM scan completed successfully.")
 
-	w.Header().Set("Content-Type", contentTypeJSON)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":             "Grype scan and remediation completed successfully",
-		"scanResult":          scanOutput,
-		"remediationScript":   remediation,
-		"remediationCommands": extractScriptBlock(remediation),
-		"pkgType":             pkgType,
-		"markdownResponse":    fmt.Sprintf("```bash\n%s\n```", extractScriptBlock(remediation)),
-		"ollamaModel":         appConfig.DefaultModel,
-		"ollamaRawResponse":   remediation,
-		"usedLlamaIndex":      body.UseAdvanced,
-		"qualityScore":        qualityScore,
-	})
+	report.RemediationScript = remediation.Script
+	report.RemediationCommands = extractScriptBlock(remediation.Script)
+	report.ScriptSafety = assessScript(report.RemediationCommands)
+	report.Advice = remediation.Advice
+	report.FallbackReason = remediation.FallbackReason
+	report.Engine = remediation.Engine
+	report.Model = remediation.Model
+	recordScan(ctx, sbomID, report, remediation.Engine)
+	return report, nil
 }
 
-func runGrypeScan(sbomFile string) (string, error) {
-	cmd := exec.Command("grype", sbomFile, "--only-fixed", "-q")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("error running Grype: %w", err)
+// advancedAnalysisQuery is the default question for LlamaIndex analysis
+const advancedAnalysisQuery = "Analyze these vulnerabilities and provide a comprehensive remediation plan"
+
+// remediationQuery asks for a JSON document matching remediationSchema, upgrading
+// each group of packages with its own package manager
+func remediationQuery(plan []RemediationGroup) string {
+	var sections []string
+	for _, group := range plan {
+		sections = append(sections, "- "+group.describe())
 	}
-	return string(output), nil
+	return fmt.Sprintf(`You are a DevSecOps expert. Given the following SBOM scan output, plan an upgrade of each vulnerable package to its fixed version.
+Use the package manager of each of these package groups for its upgrade commands:
+%s
+
+Answer with only a JSON document matching this JSON Schema, with one entry in fixes for every vulnerability and package in the scan:
+%s`, strings.Join(sections, "\n"), remediationSchema)
 }
 
-func getRemediation(scanOutput string, pkgType string, useAdvanced bool, sbomContent string) (string, error) {
-	if len(scanOutput) == 0 {
-		return "", nil // No vulnerabilities, no need for remediation
+// Remediation is a generated remediation script and what produced it
+type Remediation struct {
+	Script string
+	Engine string
+	Model  string
+	// Advice is the validated structured answer of the LLM, nil for other engines
+	Advice *RemediationAdvice
+	// FallbackReason explains why the basic engine was used instead of the LLM
+	FallbackReason string
+}
+
+// getRemediation generates a remediation script with LlamaIndex when advanced analysis is requested,
+// then with structured advice from the configured LLM provider, falling back to the rule-based plan
+func getRemediation(ctx context.Context, matches []VulnerabilityMatch, plan []RemediationGroup, useAdvanced bool, sbomContent string, model string) (*Remediation, error) {
+	if len(matches) == 0 {
+		return &Remediation{}, nil // No vulnerabilities, no need for remediation
+	}
+
+	req := LLMRequest{
+		Query:       remediationQuery(plan),
+		ScanResults: formatMatchTable(matches),
+		SBOMData:    sbomContent,
+		Model:       model,
 	}
 
 	// Try advanced analysis if requested
 	if useAdvanced {
-		// Try to use LlamaIndex for advanced analysis
-		client := NewLlamaIndexClient(appConfig.LlamaIndexEndpoint)
-		if client != nil {
-			// Advanced client creation successful
-			llamaResponse, err := client.AnalyzeVulnerabilities(scanOutput, sbomContent)
-			if err == nil {
-				// Advanced analysis successful
-				return llamaResponse, nil
-			}
-			// Log error but continue to basic remediation
-			logger.Log(fmt.Sprintf("advanced analysis failed, falling back to basic: %v", err))
-		} else {
-			// Log error but continue to basic remediation
-			logger.Log("could not initialize advanced analysis client, falling back to basic")
+		advanced := req
+		advanced.Query = advancedAnalysisQuery
+		response, err := queryChunkedLlamaIndex(ctx, advanced, matches)
+		if err == nil {
+			return &Remediation{Script: response, Engine: llamaIndexProvider.Name()}, nil
 		}
+		// Log error but continue to basic remediation
+		logger.Log(fmt.Sprintf("advanced analysis failed, falling back to basic: %v", err))
 	}
 
-	// Basic remediation with Ollama
-	ollamaErr := checkOllamaAvailability()
-	if ollamaErr != nil {
-		// Generate a simple remediation based on scan output if Ollama is not available
-		return generateBasicRemediation(scanOutput, pkgType), nil
-	}
-
-	return getOllamaRemediation(scanOutput, pkgType)
-}
-
-// generateBasicRemediation creates a simple remediation script based on the scan output
-// without requiring Ollama or other external services
-func generateBasicRemediation(_ string, pkgType string) string {
-	// Extract vulnerability information from scan output
-	var recommendations []string
-
-	// Simple parsing of the scan output to identify packages and versions
-	var packageManager string
-	var updateCommand string
-
-	switch pkgType {
-	case "python":
-		packageManager = "pip"
-		updateCommand = "pip install --upgrade"
-	case "nodejs":
-		packageManager = "npm"
-		updateCommand = "npm update"
-	case "java":
-		packageManager = "maven"
-		updateCommand = "mvn versions:use-latest-versions"
-	case "golang":
-		packageManager = "go"
-		updateCommand = "go get -u"
-	case "ruby":
-		packageManager = "gem"
-		updateCommand = "gem update"
-	case "rust":
-		packageManager = "cargo"
-		updateCommand = "cargo update"
-	default:
-		packageManager = "unknown"
-		updateCommand = "# Unknown package manager"
-	}
-
-	// Add basic header with instructions
-	recommendations = append(recommendations, fmt.Sprintf("# Basic remediation script for %s packages", packageManager))
-	recommendations = append(recommendations, "# Please review before executing")
-	recommendations = append(recommendations, "")
-
-	// Add update all command as a fallback
-	recommendations = append(recommendations, fmt.Sprintf("# Option 1: Update all packages"))
-	recommendations = append(recommendations, fmt.Sprintf("%s", updateCommand))
-	recommendations = append(recommendations, "")
-
-	// Add general security advice
-	recommendations = append(recommendations, "# Additional security recommendations:")
-	recommendations = append(recommendations, "# 1. Review your dependencies and remove unused ones")
-	recommendations = append(recommendations, "# 2. Consider using a dependency lockfile")
-	recommendations = append(recommendations, "# 3. Set up automated vulnerability scanning in your CI/CD pipeline")
-
-	return strings.Join(recommendations, "\n")
+	basic := func(reason string) *Remediation {
+		logger.Log(fmt.Sprintf("Using basic remediation: %s", reason))
+		return &Remediation{Script: generateBasicRemediation(matches), Engine: basicEngine, FallbackReason: reason}
+	}
+
+	if err := llmProvider.Available(ctx); err != nil {
+		return basic(fmt.Sprintf("%s provider unavailable: %v", llmProvider.Name(), err)), nil
+	}
+
+	advice, err := generateChunkedAdvice(ctx, llmProvider, req, matches)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return basic(fmt.Sprintf("%s remediation failed: %v", llmProvider.Name(), err)), nil
+	}
+	return &Remediation{Script: advice.script(), Engine: llmProvider.Name(), Model: llmProvider.Model(model), Advice: advice}, nil
 }
 
 func logsHandler(w http.ResponseWriter, r *http.Request) {
@@ -595,6 +1019,7 @@ func llamaIndexAnalyzeHandler(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		Query    string `json:"query"`
 		ScanData string `json:"scanData"`
+		SBOMID   string `json:"sbomId"`
 		SBOMFile string `json:"sbomFile"`
 	}
 
@@ -604,13 +1029,9 @@ func llamaIndexAnalyzeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sbomFile := body.SBOMFile
-	if sbomFile == "" {
-		sbomFile = appConfig.SBOMOutputFile
-	}
-
-	if _, err := os.Stat(sbomFile); os.IsNotExist(err) {
-		http.Error(w, "SBOM file not found. Please generate it first.", http.StatusBadRequest)
+	_, sbomFile, err := resolveSBOMFile(body.SBOMID, body.SBOMFile)
+	if err != nil {
+		http.Error(w, err.Error(), sbomLookupStatus(err))
 		return
 	}
 
@@ -621,26 +1042,25 @@ func llamaIndexAnalyzeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Use LlamaIndex for analysis
-	client := NewLlamaIndexClient(appConfig.LlamaIndexEndpoint)
 	query := body.Query
 	if query == "" {
-		query = "Analyze these vulnerabilities and provide a comprehensive remediation plan"
+		query = advancedAnalysisQuery
 	}
 
 	scanData := body.ScanData
 	if scanData == "" {
-		// Run Grype to get scan data
-		scanData, err = runGrypeScan(sbomFile)
+		// Match vulnerabilities to get scan data
+		matches, _, err := scanMatches(r.Context(), sbomFile, ScanOptions{})
 		if err != nil {
 			logger.Log(fmt.Sprintf("Error running Grype: %v", err))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		scanData = formatMatchTable(matches)
 	}
 
 	logger.Log("Running LlamaIndex analysis...")
-	llamaResponse, err := client.AnalyzeVulnerabilities(scanData, string(sbomContent))
+	llamaResponse, err := llamaIndexProvider.Generate(r.Context(), LLMRequest{Query: query, ScanResults: scanData, SBOMData: string(sbomContent)})
 	if err != nil {
 		logger.Log(fmt.Sprintf("Failed to get LlamaIndex analysis: %v", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -652,6 +1072,7 @@ func llamaIndexAnalyzeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", contentTypeJSON)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":          "LlamaIndex analysis completed successfully",
+		"sbomId":           body.SBOMID,
 		"scanData":         scanData,
 		"analysisResponse": llamaResponse,
 		"query":            query,
@@ -660,184 +1081,122 @@ func llamaIndexAnalyzeHandler(w http.ResponseWriter, r *http.Request) {
 
 // New implementation to replace remediateWithOllamaHandler
 func remediateHandler(w http.ResponseWriter, r *http.Request) {
-	sbomFile := appConfig.SBOMOutputFile
-
-	if _, err := os.Stat(sbomFile); os.IsNotExist(err) {
-		http.Error(w, "SBOM file not found. Please generate it first.", http.StatusBadRequest)
-		return
-	}
-
-	logger.Log("Starting remediation...")
-
-	// Run Grype scan to get output
-	scanOutput, err := runGrypeScan(sbomFile)
+	sbomID := r.URL.Query().Get("sbomId")
+	_, sbomFile, err := resolveSBOMFile(sbomID, "")
 	if err != nil {
-		logger.Log(fmt.Sprintf("Error running Grype for remediation: %v", err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), sbomLookupStatus(err))
 		return
 	}
 
-	if len(scanOutput) == 0 {
-		w.Header().Set("Content-Type", contentTypeJSON)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"message":           "No vulnerabilities found that need remediation",
-			"remediationScript": "",
-		})
-		return
-	}
-
-	// Try LlamaIndex first
-	client := NewLlamaIndexClient(appConfig.LlamaIndexEndpoint)
-	sbomContent, err := os.ReadFile(sbomFile)
-	if err != nil {
-		logger.Log(fmt.Sprintf("Failed to read SBOM file: %v", err))
-		http.Error(w, "Failed to read SBOM file", http.StatusInternalServerError)
-		return
+	model, verify := r.URL.Query().Get("model"), r.URL.Query().Get("verify") == "true"
+	run := func(ctx context.Context) (interface{}, error) {
+		return remediate(ctx, sbomID, sbomFile, model, verify)
 	}
-	llamaResponse, err := client.AnalyzeVulnerabilities(scanOutput, string(sbomContent))
-
-	if err == nil {
-		logger.Log("Remediation script generated using LlamaIndex.")
-		w.Header().Set("Content-Type", contentTypeJSON)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"message":           "Remediation script generated successfully using LlamaIndex",
-			"remediationScript": llamaResponse,
-			"engine":            "llamaindex",
-		})
+	if wantsStream(r) {
+		serveStream(w, r, run)
 		return
 	}
 
-	logger.Log(fmt.Sprintf("LlamaIndex analysis failed: %v. Falling back to Ollama.", err))
-
-	// Fallback to Ollama
-	pkgType := detectPackageType(scanOutput)
-	ollamaResponse, err := getOllamaRemediation(scanOutput, pkgType)
+	result, err := run(r.Context())
 	if err != nil {
-		logger.Log(fmt.Sprintf("Failed to get Ollama remediation: %v", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	logger.Log("Remediation script generated using Ollama fallback.")
-
 	w.Header().Set("Content-Type", contentTypeJSON)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":           "Remediation script generated successfully using Ollama",
-		"remediationScript": ollamaResponse,
-		"engine":            "ollama",
-		"ollamaModel":       appConfig.DefaultModel,
-	})
+	json.NewEncoder(w).Encode(result)
 }
 
-// Check if Ollama is available
-func checkOllamaAvailability() error {
-	// Ollama uses /api/generate for its API endpoint
-	url := appConfig.OllamaHost + "/api/generate"
-
-	payload := map[string]interface{}{
-		"model":  appConfig.DefaultModel,
-		"prompt": "test",
-		"stream": false,
-	}
-
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("failed to create test payload: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
+// remediate scans an SBOM and generates its remediation script and manifest patches,
+// verifying the patches on a scratch copy of the source when verify is set
+func remediate(ctx context.Context, sbomID string, sbomFile string, model string, verify bool) (map[string]interface{}, error) {
+	logger.Log("Starting remediation...")
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	// Match vulnerabilities to get scan output
+	matches, _, err := scanMatches(ctx, sbomFile, ScanOptions{})
 	if err != nil {
-		return fmt.Errorf("failed to connect to Ollama: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("ollama service error (status %d): %s", resp.StatusCode, string(bodyBytes))
+		logger.Log(fmt.Sprintf("Error running Grype for remediation: %v", err))
+		return nil, err
 	}
 
-	return nil
-}
-
-// Get remediation script from Ollama
-func getOllamaRemediation(scanOutput string, pkgType string) (string, error) {
-	// Check Ollama availability first
-	if err := checkOllamaAvailability(); err != nil {
-		logger.Log(fmt.Sprintf("ollama availability check failed: %v", err))
-		return "", fmt.Errorf("ollama service is not available, please ensure ollama is running and the model '%s' is installed: %w", appConfig.DefaultModel, err)
+	if len(matches) == 0 {
+		return map[string]interface{}{
+			"message":           "No vulnerabilities found that need remediation",
+			"sbomId":            sbomID,
+			"remediationScript": "",
+		}, nil
 	}
 
-	prompt := fmt.Sprintf(`You are a DevSecOps expert. Given the following SBOM scan output, write a clean script that upgrades each vulnerable %s to its fixed version.
-
-Only output the script in a code block.
-
-SBOM Scan:
-%s
-`, pkgType, scanOutput)
-
-	logger.Log(fmt.Sprintf("Using Ollama model: %s", appConfig.DefaultModel))
-
-	llm, err := ollama.New(
-		ollama.WithModel(appConfig.DefaultModel),
-		ollama.WithServerURL(appConfig.OllamaHost),
-	)
+	sbomContent, err := os.ReadFile(sbomFile)
 	if err != nil {
-		return "", fmt.Errorf("failed to initialize Ollama client: %w", err)
+		logger.Log(fmt.Sprintf("Failed to read SBOM file: %v", err))
+		return nil, fmt.Errorf("failed to read SBOM file: %w", err)
 	}
+	plan := planRemediation(matches)
+	pkgType := packageTypeLabels(plan)
 
-	response, err := llm.Call(context.Background(), prompt)
+	// Try LlamaIndex first, then the configured provider, then the rule-based plan
+	stream := progressFrom(ctx)
+	stream.Step(StageRemediation, ProgressStarted, "")
+	remediation, err := getRemediation(ctx, matches, plan, true, string(sbomContent), model)
 	if err != nil {
-		return "", fmt.Errorf("failed to get response from Ollama LLM: %w", err)
-	}
-
-	return response, nil
-}
-
-// Detect package type from scan output
-func detectPackageType(scanOutput string) string {
-	pkgType := "package" // default fallback
-
-	if strings.Contains(scanOutput, "python") {
-		pkgType = "Python package"
-	} else if strings.Contains(scanOutput, "nodejs") || strings.Contains(scanOutput, "npm") {
-		pkgType = "Node.js package"
-	} else if strings.Contains(scanOutput, "java") || strings.Contains(scanOutput, "maven") {
-		pkgType = "Java package"
-	} else if strings.Contains(scanOutput, "golang") || strings.Contains(scanOutput, "go-module") {
-		pkgType = "Go package"
-	} else if strings.Contains(scanOutput, "ruby") || strings.Contains(scanOutput, "gem") {
-		pkgType = "Ruby gem"
-	} else if strings.Contains(scanOutput, "rust") || strings.Contains(scanOutput, "cargo") {
-		pkgType = "Rust crate"
-	}
-
-	return pkgType
-}
-
-// Clone a Git repository
-func cloneGitRepo(repoURL string, dest string) error {
-	if err := os.RemoveAll(dest); err != nil {
-		return fmt.Errorf("failed to remove existing git clone directory: %w", err)
-	}
-
-	if _, err := exec.LookPath("git"); err != nil {
-		return fmt.Errorf("git is not installed in the container: %w", err)
+		logger.Log(fmt.Sprintf("Failed to generate remediation: %v", err))
+		stream.Step(StageRemediation, ProgressFailed, err.Error())
+		return nil, fmt.Errorf("failed to generate remediation: %w", err)
+	}
+	stream.Step(StageRemediation, ProgressCompleted, "")
+	script, engine, usedModel := remediation.Script, remediation.Engine, remediation.Model
+
+	logger.Log(fmt.Sprintf("Remediation script generated using %s.", engine))
+	safety := assessScript(extractScriptBlock(script))
+	if safety.Risk != RiskSafe {
+		logger.Log(fmt.Sprintf("Remediation script from %s rated %s, review it before running", engine, safety.Risk))
+	}
+	recordScan(ctx, sbomID, &ScanReport{ScanResult: formatMatchTable(matches), Vulnerabilities: matches, PkgType: pkgType, RemediationScript: script, RemediationPlan: plan,
+		Engine: engine, Model: usedModel, ScriptSafety: safety, Advice: remediation.Advice, FallbackReason: remediation.FallbackReason}, engine)
+
+	result := map[string]interface{}{
+		"message":           fmt.Sprintf("Remediation script generated successfully using %s", engine),
+		"sbomId":            sbomID,
+		"remediationScript": script,
+		"remediationPlan":   plan,
+		"scriptSafety":      safety,
+		"engine":            engine,
+	}
+	if remediation.Advice != nil {
+		result["advice"] = remediation.Advice
+	}
+	if remediation.FallbackReason != "" {
+		result["fallbackReason"] = remediation.FallbackReason
+	}
+	if usedModel != "" {
+		result["model"] = usedModel
+		result["ollamaModel"] = usedModel
+	}
+
+	// Directory and git sources also get diffs bumping the versions in their manifests,
+	// in verify mode they are applied to a scratch copy that is rescanned
+	var patches []ManifestPatch
+	if verify {
+		var verification *Verification
+		verification, patches, err = verifyRemediation(ctx, sbomID, matches, plan)
+		if err != nil {
+			logger.Log(fmt.Sprintf("Warning: Could not verify remediation: %v", err))
+			result["verificationWarning"] = err.Error()
+		} else {
+			result["verification"] = verification
+		}
+	} else {
+		patches, err = patchesForSBOM(ctx, sbomID, plan)
+		if err != nil && !errors.Is(err, ErrNoSourceTree) {
+			logger.Log(fmt.Sprintf("Warning: Could not generate manifest patches: %v", err))
+			result["patchWarning"] = err.Error()
+		}
 	}
-
-	cmd := exec.Command("git", "clone", "--depth", "1", repoURL, dest)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to clone git repository: %w", err)
+	if len(patches) > 0 {
+		result["patches"] = patches
+		result["patch"] = joinPatches(patches)
 	}
-	return nil
+	return result, nil
 }
 
 // Get all source tags
@@ -845,8 +1204,8 @@ func allSourceTags() []string {
 	return collections.TaggedValueSet[source.Provider]{}.Join(sourceproviders.All("", nil)...).Tags()
 }
 
-// Save SBOM to file
-func saveSBOMToFile(s *sbom.SBOM, filename string) error {
+// Save SBOM to file in the requested format
+func saveSBOMToFile(s *sbom.SBOM, filename string, outputFormat SBOMFormat) error {
 	file, err := os.Create(filename)
 	if err != nil {
 		return fmt.Errorf("failed to create SBOM file: %w", err)
@@ -857,9 +1216,9 @@ func saveSBOMToFile(s *sbom.SBOM, filename string) error {
 		}
 	}()
 
-	encoder, err := cyclonedxjson.NewFormatEncoderWithConfig(cyclonedxjson.DefaultEncoderConfig())
+	encoder, err := outputFormat.Encoder()
 	if err != nil {
-		return fmt.Errorf("failed to create CycloneDX encoder: %w", err)
+		return fmt.Errorf("failed to create %s encoder: %w", outputFormat.Name, err)
 	}
 
 	if err := encoder.Encode(file, *s); err != nil {
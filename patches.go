@@ -0,0 +1,694 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/anchore/packageurl-go"
+	"github.com/gorilla/mux"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// ErrNoSourceTree is returned when an SBOM's source has no files to patch, such as a container image
+var ErrNoSourceTree = errors.New("manifest patches need a directory or git source")
+
+// ManifestPatch is a unified diff that bumps vulnerable versions in one file of the source
+type ManifestPatch struct {
+	File     string   `json:"file"`
+	Diff     string   `json:"diff"`
+	Packages []string `json:"packages"`
+	Note     string   `json:"note,omitempty"`
+}
+
+// manifestPatcher bumps one package in the lines of a manifest, reporting whether anything changed
+type manifestPatcher func(lines []string, p PackageRef, version string) ([]string, bool)
+
+// manifestCompanions are the files declaring the packages of a lockfile syft catalogs
+var manifestCompanions = map[string][]string{
+	"package-lock.json": {"package.json"},
+	"Cargo.lock":        {"Cargo.toml"},
+	"go.sum":            {"go.mod"},
+}
+
+// manifestNotes are follow-up steps for files whose lockfiles the patch can't update
+var manifestNotes = map[string]string{
+	"go.mod":     "run go mod tidy to update go.sum",
+	"Cargo.toml": "run cargo update to refresh Cargo.lock",
+}
+
+// patcherFor picks the patcher for a manifest by file name
+func patcherFor(path string) manifestPatcher {
+	base := filepath.Base(path)
+	switch {
+	case strings.HasPrefix(base, "requirements") && strings.HasSuffix(base, ".txt"):
+		return patchRequirements
+	case base == "package.json":
+		return patchPackageJSON
+	case base == "package-lock.json":
+		return patchPackageLock
+	case base == "go.mod":
+		return patchGoMod
+	case base == "pom.xml":
+		return patchPom
+	case base == "Gemfile.lock":
+		return patchGemfileLock
+	case base == "Cargo.toml":
+		return patchCargoToml
+	}
+	return nil
+}
+
+// sourceTree returns a directory holding the files of an SBOM's source, cloning git
+// sources at their recorded commit into a temporary directory that cleanup removes
+func sourceTree(ctx context.Context, source string) (string, func(), error) {
+	if info, err := os.Stat(source); err == nil && info.IsDir() {
+		return source, func() {}, nil
+	}
+	spec, err := parseGitSource(source)
+	if err != nil {
+		return "", nil, err
+	}
+	if spec != nil {
+		checkout, err := checkoutGitSource(ctx, *spec)
+		if err != nil {
+			return "", nil, err
+		}
+		return checkout.Dir, checkout.Close, nil
+	}
+	return "", nil, fmt.Errorf("%w: %s", ErrNoSourceTree, source)
+}
+
+// patchedFile is a file under the source root being edited
+type patchedFile struct {
+	original string
+	lines    []string
+	packages []string
+}
+
+// patchSet collects the edits to the files under a source root
+type patchSet struct {
+	root  string
+	files map[string]*patchedFile
+}
+
+func newPatchSet(root string) *patchSet {
+	return &patchSet{root: root, files: make(map[string]*patchedFile)}
+}
+
+// load reads a file relative to the root once, returning nil unless it is a regular file that is
+// still inside the root once symlinks are followed
+func (s *patchSet) load(rel string) *patchedFile {
+	rel = strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+rel)), "/")
+	if f, ok := s.files[rel]; ok {
+		return f
+	}
+	var f *patchedFile
+	if path, _, err := rootedFile(s.root, rel); err == nil {
+		if data, err := os.ReadFile(path); err == nil {
+			f = &patchedFile{original: string(data), lines: strings.Split(string(data), "\n")}
+		}
+	}
+	s.files[rel] = f
+	return f
+}
+
+// apply runs a patcher over a file, remembering the package when it changed anything
+func (s *patchSet) apply(rel string, patcher manifestPatcher, p PackageRef, version string) {
+	f := s.load(rel)
+	if f == nil || patcher == nil {
+		return
+	}
+	lines, changed := patcher(f.lines, p, version)
+	if changed {
+		f.lines = lines
+		f.packages = append(f.packages, p.Name+"@"+version)
+	}
+}
+
+// patches renders a unified diff for every changed file, in path order
+func (s *patchSet) patches() ([]ManifestPatch, error) {
+	var paths []string
+	for rel, f := range s.files {
+		if f != nil && len(f.packages) > 0 {
+			paths = append(paths, rel)
+		}
+	}
+	sort.Strings(paths)
+
+	patches := make([]ManifestPatch, 0, len(paths))
+	for _, rel := range paths {
+		f := s.files[rel]
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        diffLines(strings.Split(f.original, "\n")),
+			B:        diffLines(f.lines),
+			FromFile: "a/" + rel,
+			ToFile:   "b/" + rel,
+			Context:  3,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to diff %s: %w", rel, err)
+		}
+		if diff == "" {
+			continue
+		}
+		patches = append(patches, ManifestPatch{
+			File:     rel,
+			Diff:     diff,
+			Packages: uniqueSorted(f.packages),
+			Note:     manifestNotes[filepath.Base(rel)],
+		})
+	}
+	return patches, nil
+}
+
+// write saves the changed files over the originals under the root, refusing anything that
+// isn't a regular file inside it so a symlinked manifest can't redirect the write
+func (s *patchSet) write() error {
+	for rel, f := range s.files {
+		if f == nil || len(f.packages) == 0 {
+			continue
+		}
+		path, info, err := rootedFile(s.root, rel)
+		if err != nil {
+			return fmt.Errorf("failed to patch %s: %w", rel, err)
+		}
+		out, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return fmt.Errorf("failed to patch %s: %w", rel, err)
+		}
+		if _, err := out.WriteString(strings.Join(f.lines, "\n")); err != nil {
+			out.Close()
+			return fmt.Errorf("failed to patch %s: %w", rel, err)
+		}
+		if err := out.Close(); err != nil {
+			return fmt.Errorf("failed to patch %s: %w", rel, err)
+		}
+	}
+	return nil
+}
+
+// rootedFile resolves a path relative to root, accepting only a regular file that is still
+// inside root once every symlink on the way is followed
+func rootedFile(root string, rel string) (string, os.FileInfo, error) {
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return "", nil, fmt.Errorf("%s is not a regular file", rel)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", nil, err
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if inside, err := filepath.Rel(realRoot, realPath); err != nil || !filepath.IsLocal(inside) {
+		return "", nil, fmt.Errorf("%s leads outside the source", rel)
+	}
+	return path, info, nil
+}
+
+// diffLines restores the line endings split off a file's content
+func diffLines(lines []string) []string {
+	result := make([]string, 0, len(lines))
+	for i, line := range lines {
+		if i == len(lines)-1 && line == "" {
+			break
+		}
+		result = append(result, line+"\n")
+	}
+	return result
+}
+
+// generatePatches bumps the vulnerable versions in the plan in the manifests under root
+func generatePatches(root string, plan []RemediationGroup) ([]ManifestPatch, error) {
+	return buildPatchSet(root, plan).patches()
+}
+
+// buildPatchSet applies the plan's upgrades to the manifests under root in memory
+func buildPatchSet(root string, plan []RemediationGroup) *patchSet {
+	set := newPatchSet(root)
+	for _, group := range plan {
+		var fixes []RemediationStep
+		for _, step := range group.Steps {
+			if step.FixedVersion != "" {
+				fixes = append(fixes, step)
+			}
+		}
+		if len(fixes) == 0 {
+			continue
+		}
+
+		if group.Location != "" {
+			files := []string{group.Location}
+			for _, companion := range manifestCompanions[filepath.Base(group.Location)] {
+				files = append(files, filepath.Join(filepath.Dir(group.Location), companion))
+			}
+			for _, file := range files {
+				for _, step := range fixes {
+					set.apply(file, patcherFor(file), step.Package, step.FixedVersion)
+				}
+			}
+		}
+
+		for _, dockerfile := range findDockerfiles(root) {
+			switch {
+			case group.Ecosystem == "go":
+				for _, step := range fixes {
+					if step.Package.Name == "stdlib" {
+						set.apply(dockerfile, patchGolangImage, step.Package, step.FixedVersion)
+					}
+				}
+			case group.Location == "":
+				set.applyOSUpgrades(dockerfile, group.Ecosystem, fixes)
+			}
+		}
+	}
+	return set
+}
+
+// findDockerfiles lists the Dockerfiles at the top of the source, leaving out symlinks
+func findDockerfiles(root string) []string {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, e := range entries {
+		name := strings.ToLower(e.Name())
+		if e.Type().IsRegular() && (name == "dockerfile" || strings.HasPrefix(name, "dockerfile.") || strings.HasSuffix(name, ".dockerfile")) {
+			files = append(files, e.Name())
+		}
+	}
+	return files
+}
+
+var (
+	requirementLine     = regexp.MustCompile(`^(\s*)([A-Za-z0-9][A-Za-z0-9._-]*)(\[[^\]]*\])?([^;#]*)(.*)$`)
+	pythonNameSeparator = regexp.MustCompile(`[-_.]+`)
+)
+
+// normalizePythonName compares distribution names the way pip does
+func normalizePythonName(name string) string {
+	return strings.ToLower(pythonNameSeparator.ReplaceAllString(name, "-"))
+}
+
+// patchRequirements pins exact requirements to the fix and raises the floor of ranges
+func patchRequirements(lines []string, p PackageRef, version string) ([]string, bool) {
+	changed := false
+	for i, line := range lines {
+		m := requirementLine.FindStringSubmatch(line)
+		if m == nil || normalizePythonName(m[2]) != normalizePythonName(p.Name) {
+			continue
+		}
+		spacing := m[4][len(strings.TrimRight(m[4], " \t")):]
+		patched := m[1] + m[2] + m[3] + patchRequirementSpec(strings.TrimSpace(m[4]), version) + spacing + m[5]
+		if patched != line {
+			lines[i] = patched
+			changed = true
+		}
+	}
+	return lines, changed
+}
+
+// requirementOperators lists the PEP 440 comparison operators, longest first
+var requirementOperators = []string{"===", "==", "~=", "!=", "<=", ">=", "<", ">"}
+
+// patchRequirementSpec replaces the lower bounds of a version specifier such as ">=2.0,<3" with
+// the fix and keeps its other clauses. Exact and compatible-release specifiers, and ranges whose
+// other clauses exclude the fix, are pinned to it instead.
+func patchRequirementSpec(spec string, version string) string {
+	pin := "==" + version
+	if spec == "" {
+		return pin
+	}
+
+	var kept []string
+	for _, clause := range strings.Split(spec, ",") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		operator := ""
+		for _, op := range requirementOperators {
+			if strings.HasPrefix(clause, op) {
+				operator = op
+				break
+			}
+		}
+		bound := strings.TrimSpace(strings.TrimPrefix(clause, operator))
+
+		switch operator {
+		case ">=", ">":
+			// Replaced by the fix as the new floor
+		case "<", "<=", "!=":
+			cmp := compareVersions(version, bound)
+			excluded := cmp != versionsIncomparable &&
+				(operator == "<" && cmp >= 0 || operator == "<=" && cmp > 0 || operator == "!=" && cmp == 0)
+			if excluded {
+				return pin
+			}
+			kept = append(kept, clause)
+		default:
+			return pin
+		}
+	}
+	return strings.Join(append([]string{">=" + version}, kept...), ",")
+}
+
+var (
+	npmDependencySection = regexp.MustCompile(`^\s*"(dependencies|devDependencies|optionalDependencies|peerDependencies)"\s*:\s*\{`)
+	npmVersionRange      = regexp.MustCompile(`^(\^|~|>=|=)?\s*\d`)
+)
+
+// patchPackageJSON updates the dependency ranges of a package, keeping their caret or tilde
+func patchPackageJSON(lines []string, p PackageRef, version string) ([]string, bool) {
+	entry := regexp.MustCompile(`^(\s*"` + regexp.QuoteMeta(p.Name) + `"\s*:\s*")([^"]*)(".*)$`)
+	inDependencies, changed := false, false
+	for i, line := range lines {
+		if npmDependencySection.MatchString(line) {
+			inDependencies = !strings.Contains(line, "}")
+			continue
+		}
+		if !inDependencies {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "}") {
+			inDependencies = false
+			continue
+		}
+		m := entry.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		rangePrefix := npmVersionRange.FindStringSubmatch(m[2])
+		if rangePrefix == nil {
+			continue // tags, URLs and workspaces are left alone
+		}
+		lines[i] = m[1] + rangePrefix[1] + version + m[3]
+		changed = changed || lines[i] != line
+	}
+	return lines, changed
+}
+
+// patchPackageLock updates the locked version and tarball of a package and drops its
+// integrity hash, which npm fills in again on the next install
+func patchPackageLock(lines []string, p PackageRef, version string) ([]string, bool) {
+	entry := regexp.MustCompile(`^(\s*)"(?:[^"]*node_modules/)?` + regexp.QuoteMeta(p.Name) + `"\s*:\s*\{\s*$`)
+	installedVersion := `"version": "` + p.Version + `"`
+	changed := false
+	for start := 0; start < len(lines); start++ {
+		m := entry.FindStringSubmatch(lines[start])
+		if m == nil {
+			continue
+		}
+		end := start + 1
+		for end < len(lines) && !strings.HasPrefix(lines[end], m[1]+"}") {
+			end++
+		}
+		if end >= len(lines) || start+1 >= end {
+			continue
+		}
+		childIndent := lines[start+1][:len(lines[start+1])-len(strings.TrimLeft(lines[start+1], " \t"))]
+		isChild := func(line string) bool {
+			return strings.HasPrefix(line, childIndent) && !strings.HasPrefix(line[len(childIndent):], " ")
+		}
+
+		locked := false
+		for _, line := range lines[start+1 : end] {
+			if isChild(line) && strings.Contains(line, installedVersion) {
+				locked = true
+			}
+		}
+		if !locked {
+			continue
+		}
+
+		var body []string
+		for _, line := range lines[start+1 : end] {
+			trimmed := strings.TrimSpace(line)
+			switch {
+			case !isChild(line):
+			case strings.HasPrefix(trimmed, `"version"`):
+				line = strings.Replace(line, installedVersion, `"version": "`+version+`"`, 1)
+			case strings.HasPrefix(trimmed, `"resolved"`):
+				line = strings.Replace(line, "-"+p.Version+".tgz", "-"+version+".tgz", 1)
+			case strings.HasPrefix(trimmed, `"integrity"`):
+				if !strings.HasSuffix(trimmed, ",") && len(body) > 0 {
+					body[len(body)-1] = strings.TrimSuffix(body[len(body)-1], ",")
+				}
+				continue
+			}
+			body = append(body, line)
+		}
+
+		patched := append(append(append([]string{}, lines[:start+1]...), body...), lines[end:]...)
+		start += len(body)
+		lines = patched
+		changed = true
+	}
+	return lines, changed
+}
+
+// patchGoMod bumps a module in require lines and blocks
+func patchGoMod(lines []string, p PackageRef, version string) ([]string, bool) {
+	installed := strings.TrimPrefix(p.Version, "v")
+	requirement := regexp.MustCompile(`^(\s*(?:require\s+)?` + regexp.QuoteMeta(p.Name) + `\s+)v` + regexp.QuoteMeta(installed) + `(\s.*)?$`)
+	changed := false
+	for i, line := range lines {
+		if requirement.MatchString(line) {
+			lines[i] = requirement.ReplaceAllString(line, "${1}v"+strings.TrimPrefix(version, "v")+"${2}")
+			changed = true
+		}
+	}
+	return lines, changed
+}
+
+var (
+	pomElement  = regexp.MustCompile(`<(groupId|artifactId|version)>\s*([^<]*?)\s*</(?:groupId|artifactId|version)>`)
+	pomProperty = regexp.MustCompile(`^\$\{([^}]+)\}$`)
+)
+
+// patchPom bumps a dependency's version element, or the property it refers to
+func patchPom(lines []string, p PackageRef, version string) ([]string, bool) {
+	groupID, artifactID := "", p.Name
+	if purl, err := packageurl.FromString(p.PURL); err == nil {
+		groupID, artifactID = purl.Namespace, purl.Name
+	}
+
+	changed := false
+	inDependency := false
+	var group, artifact, value string
+	versionLine := -1
+	for i, line := range lines {
+		switch {
+		case strings.Contains(line, "<dependency>"):
+			inDependency, group, artifact, value, versionLine = true, "", "", "", -1
+		case strings.Contains(line, "</dependency>"):
+			inDependency = false
+			if artifact != artifactID || (groupID != "" && group != groupID) || versionLine < 0 {
+				continue
+			}
+			if value == p.Version {
+				lines[versionLine] = strings.Replace(lines[versionLine], ">"+p.Version+"<", ">"+version+"<", 1)
+				changed = true
+			} else if m := pomProperty.FindStringSubmatch(value); m != nil {
+				changed = patchPomProperty(lines, m[1], p.Version, version) || changed
+			}
+		case inDependency:
+			if m := pomElement.FindStringSubmatch(line); m != nil {
+				switch m[1] {
+				case "groupId":
+					group = m[2]
+				case "artifactId":
+					artifact = m[2]
+				case "version":
+					value, versionLine = m[2], i
+				}
+			}
+		}
+	}
+	return lines, changed
+}
+
+// patchPomProperty bumps a version property in the POM's properties
+func patchPomProperty(lines []string, name string, installed string, version string) bool {
+	property := regexp.MustCompile(`<` + regexp.QuoteMeta(name) + `>\s*` + regexp.QuoteMeta(installed) + `\s*</` + regexp.QuoteMeta(name) + `>`)
+	changed := false
+	for i, line := range lines {
+		if property.MatchString(line) {
+			lines[i] = property.ReplaceAllString(line, "<"+name+">"+version+"</"+name+">")
+			changed = true
+		}
+	}
+	return changed
+}
+
+// patchGemfileLock bumps a gem in the lockfile's specs
+func patchGemfileLock(lines []string, p PackageRef, version string) ([]string, bool) {
+	spec := "    " + p.Name + " (" + p.Version + ")"
+	changed := false
+	for i, line := range lines {
+		if line == spec || strings.HasPrefix(line, spec+" ") {
+			lines[i] = strings.Replace(line, "("+p.Version+")", "("+version+")", 1)
+			changed = true
+		}
+	}
+	return lines, changed
+}
+
+// patchCargoToml sets a crate's version requirement in any dependencies table
+func patchCargoToml(lines []string, p PackageRef, version string) ([]string, bool) {
+	simple := regexp.MustCompile(`^(\s*` + regexp.QuoteMeta(p.Name) + `\s*=\s*")([\^~=]|>=)?[^"]*(".*)$`)
+	table := regexp.MustCompile(`^(\s*` + regexp.QuoteMeta(p.Name) + `\s*=\s*\{.*\bversion\s*=\s*")([\^~=]|>=)?[^"]*(".*)$`)
+	inDependencies, changed := false, false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			inDependencies = strings.Contains(trimmed, "dependencies")
+			continue
+		}
+		if !inDependencies {
+			continue
+		}
+		for _, re := range []*regexp.Regexp{table, simple} {
+			if m := re.FindStringSubmatch(line); m != nil {
+				lines[i] = m[1] + m[2] + version + m[3]
+				changed = changed || lines[i] != line
+				break
+			}
+		}
+	}
+	return lines, changed
+}
+
+var golangImage = regexp.MustCompile(`^(\s*FROM\s+(?:--\S+\s+)*(?:\S+/)?golang:)(\d+(?:\.\d+)*)(\S*.*)$`)
+
+// patchGolangImage moves golang base images to the Go release that fixes the standard library
+func patchGolangImage(lines []string, _ PackageRef, version string) ([]string, bool) {
+	version = strings.TrimPrefix(strings.TrimPrefix(version, "go"), "v")
+	changed := false
+	for i, line := range lines {
+		m := golangImage.FindStringSubmatch(line)
+		if m == nil || compareVersions(m[2], version) >= 0 {
+			continue
+		}
+		lines[i] = m[1] + version + m[3]
+		changed = true
+	}
+	return lines, changed
+}
+
+// applyOSUpgrades adds a step upgrading the vulnerable OS packages after the final FROM line
+func (s *patchSet) applyOSUpgrades(rel string, ecosystem string, steps []RemediationStep) {
+	var specs []string
+	for _, step := range steps {
+		switch ecosystem {
+		case "apt":
+			specs = append(specs, step.Package.Name+"="+step.FixedVersion)
+		case "apk":
+			specs = append(specs, "'"+step.Package.Name+">="+step.FixedVersion+"'")
+		case "dnf":
+			specs = append(specs, step.Package.Name+"-"+step.FixedVersion)
+		}
+	}
+	if len(specs) == 0 {
+		return
+	}
+
+	var run string
+	switch ecosystem {
+	case "apt":
+		run = "RUN apt-get update && apt-get install -y --only-upgrade " + strings.Join(specs, " ") + " && rm -rf /var/lib/apt/lists/*"
+	case "apk":
+		run = "RUN apk add --no-cache --upgrade " + strings.Join(specs, " ")
+	case "dnf":
+		run = "RUN dnf upgrade -y " + strings.Join(specs, " ") + " && dnf clean all"
+	}
+
+	f := s.load(rel)
+	if f == nil {
+		return
+	}
+	last := -1
+	for i, line := range f.lines {
+		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(line)), "FROM ") {
+			last = i
+		}
+	}
+	if last < 0 {
+		return
+	}
+	f.lines = append(append(append([]string{}, f.lines[:last+1]...), run), f.lines[last+1:]...)
+	for _, step := range steps {
+		f.packages = append(f.packages, step.Package.Name+"@"+step.FixedVersion)
+	}
+}
+
+// patchesForSBOM generates manifest patches for a stored SBOM's source
+func patchesForSBOM(ctx context.Context, id string, plan []RemediationGroup) ([]ManifestPatch, error) {
+	rec, _, err := store.GetSBOM(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	root, cleanup, err := sourceTree(ctx, rec.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	return generatePatches(root, plan)
+}
+
+// joinPatches concatenates the diffs into one patch for git apply
+func joinPatches(patches []ManifestPatch) string {
+	var b strings.Builder
+	for _, p := range patches {
+		b.WriteString(p.Diff)
+	}
+	return b.String()
+}
+
+// sbomPatchHandler returns the manifest patches for a stored SBOM as one unified diff,
+// so `curl .../sboms/{id}/patch | git apply` applies the fixes
+func sbomPatchHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	rec, scans, err := store.GetSBOM(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), sbomLookupStatus(err))
+		return
+	}
+
+	var matches []VulnerabilityMatch
+	if len(scans) > 0 && scans[0].Matches != nil {
+		matches = scans[0].Matches
+	} else if matches, _, err = scanMatches(r.Context(), rec.File, ScanOptions{}); err != nil {
+		logger.Log(fmt.Sprintf("Error running Grype for patches: %v", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	patches, err := patchesForSBOM(r.Context(), id, planRemediation(matches))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrNoSourceTree) {
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-diff")
+	w.Write([]byte(joinPatches(patches)))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPatchSetLoadStaysInsideRoot(t *testing.T) {
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "outside.txt"), []byte("requests==1.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+	if err := os.MkdirAll(filepath.Join(root, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "app", "requirements.txt"), []byte("flask==1.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"absolute.txt": filepath.Join(base, "outside.txt"),
+		"climbing.txt": "../outside.txt",
+		"parent":       "..",
+		"inside.txt":   "app/requirements.txt",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set := newPatchSet(root)
+	for _, rel := range []string{"absolute.txt", "climbing.txt", "parent/outside.txt", "../outside.txt", "app", "inside.txt"} {
+		if f := set.load(rel); f != nil {
+			t.Errorf("expected %s not to load, got %q", rel, f.original)
+		}
+	}
+	if f := set.load("app/requirements.txt"); f == nil || f.original != "flask==1.0\n" {
+		t.Errorf("expected app/requirements.txt to load, got %v", f)
+	}
+}
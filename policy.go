@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// Policy rule scopes, a rule is evaluated once per item in its scope
+const (
+	ScopeVulnerability = "vulnerability"
+	ScopePackage       = "package"
+	ScopeSBOM          = "sbom"
+)
+
+const maxPolicySize = 1 << 20
+
+const (
+	// celCostLimit caps the work of one CEL evaluation, rules come from request bodies
+	celCostLimit = 1_000_000
+	// celInterruptCheckFrequency is how many comprehension iterations run between deadline checks
+	celInterruptCheckFrequency = 100
+	// policyEvalTimeout bounds the evaluation of all the rules of a policy
+	policyEvalTimeout = 10 * time.Second
+)
+
+// PolicyRule is one check of a policy. A rule is either declarative (severity,
+// licenses, min-quality-score, max-vulnerabilities) or a CEL expression that
+// evaluates to true for every item that violates it.
+type PolicyRule struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description"`
+	Scope       string `json:"scope,omitempty" yaml:"scope"`
+
+	Severity           []string `json:"severity,omitempty" yaml:"severity"`
+	FixAvailable       *bool    `json:"fixAvailable,omitempty" yaml:"fix-available"`
+	Licenses           []string `json:"licenses,omitempty" yaml:"licenses"`
+	MinQualityScore    *float64 `json:"minQualityScore,omitempty" yaml:"min-quality-score"`
+	MaxVulnerabilities *int     `json:"maxVulnerabilities,omitempty" yaml:"max-vulnerabilities"`
+
+	CEL string `json:"cel,omitempty" yaml:"cel"`
+
+	program cel.Program
+}
+
+// Policy is a named set of rules an SBOM and its scan must satisfy
+type Policy struct {
+	Name  string       `json:"name" yaml:"name"`
+	Rules []PolicyRule `json:"rules" yaml:"rules"`
+}
+
+// PolicyViolation is one item that broke a rule
+type PolicyViolation struct {
+	Rule        string `json:"rule"`
+	Description string `json:"description,omitempty"`
+	Subject     string `json:"subject"`
+	Message     string `json:"message"`
+}
+
+// PolicyVerdict is the outcome of evaluating a policy against a stored SBOM
+type PolicyVerdict struct {
+	Policy         string            `json:"policy"`
+	SBOMID         string            `json:"sbomId"`
+	Pass           bool              `json:"pass"`
+	Verdict        string            `json:"verdict"`
+	Violations     []PolicyViolation `json:"violations"`
+	Warnings       []string          `json:"warnings,omitempty"`
+	RulesEvaluated int               `json:"rulesEvaluated"`
+	EvaluatedAt    time.Time         `json:"evaluatedAt"`
+}
+
+// defaultPolicy applies when no policy file is configured
+var defaultPolicy = Policy{
+	Name: "default",
+	Rules: []PolicyRule{
+		{
+			Name:         "no-fixable-critical",
+			Description:  "No critical vulnerabilities with a fix available",
+			Severity:     []string{"critical"},
+			FixAvailable: boolPtr(true),
+		},
+		{
+			Name:        "no-gpl-3.0",
+			Description: "No GPL-3.0 licensed packages in distributed images",
+			Licenses:    []string{"GPL-3.0"},
+		},
+		{
+			Name:            "min-quality",
+			Description:     "SBOM quality score of at least 7",
+			MinQualityScore: float64Ptr(7),
+		},
+	},
+}
+
+func boolPtr(v bool) *bool          { return &v }
+func float64Ptr(v float64) *float64 { return &v }
+
+// policyEnv declares the variables available to CEL rules
+var policyEnv, policyEnvErr = cel.NewEnv(
+	cel.Variable("vuln", cel.DynType),
+	cel.Variable("pkg", cel.DynType),
+	cel.Variable("sbom", cel.DynType),
+)
+
+// parsePolicy reads a YAML or JSON policy and compiles its rules
+func parsePolicy(data []byte) (*Policy, error) {
+	var parsed Policy
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	if parsed.Name == "" {
+		parsed.Name = "unnamed"
+	}
+	if err := parsed.compile(); err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+// loadPolicy reads the server's policy file, falling back to the default policy when it doesn't exist
+func loadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		loaded := defaultPolicy
+		loaded.Rules = append([]PolicyRule(nil), defaultPolicy.Rules...)
+		return &loaded, loaded.compile()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+	loaded, err := parsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	return loaded, nil
+}
+
+// compile validates every rule, infers its scope and compiles CEL expressions
+func (p *Policy) compile() error {
+	if policyEnvErr != nil {
+		return fmt.Errorf("failed to create policy environment: %w", policyEnvErr)
+	}
+	if len(p.Rules) == 0 {
+		return errors.New("policy has no rules")
+	}
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+
+		kinds := 0
+		for _, set := range []bool{
+			len(rule.Severity) > 0 || rule.FixAvailable != nil,
+			len(rule.Licenses) > 0,
+			rule.MinQualityScore != nil || rule.MaxVulnerabilities != nil,
+			rule.CEL != "",
+		} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return fmt.Errorf("rule %s: set exactly one of severity/fix-available, licenses, min-quality-score/max-vulnerabilities or cel", rule.Name)
+		}
+
+		switch {
+		case len(rule.Severity) > 0 || rule.FixAvailable != nil:
+			rule.Scope = ScopeVulnerability
+			for _, severity := range rule.Severity {
+				if severityRank(severity) < 0 {
+					return fmt.Errorf("rule %s: unknown severity %q, allowed values are %s", rule.Name, severity, strings.Join(severityLevels, ", "))
+				}
+			}
+		case len(rule.Licenses) > 0:
+			rule.Scope = ScopePackage
+		case rule.CEL == "":
+			rule.Scope = ScopeSBOM
+		default:
+			if rule.Scope == "" {
+				rule.Scope = ScopeVulnerability
+			}
+			if rule.Scope != ScopeVulnerability && rule.Scope != ScopePackage && rule.Scope != ScopeSBOM {
+				return fmt.Errorf("rule %s: unknown scope %q, allowed values are %s, %s, %s", rule.Name, rule.Scope, ScopeVulnerability, ScopePackage, ScopeSBOM)
+			}
+			ast, issues := policyEnv.Compile(rule.CEL)
+			if issues != nil && issues.Err() != nil {
+				return fmt.Errorf("rule %s: %w", rule.Name, issues.Err())
+			}
+			if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+				return fmt.Errorf("rule %s: expression must return a bool, got %s", rule.Name, ast.OutputType())
+			}
+			program, err := policyEnv.Program(ast, cel.CostLimit(celCostLimit), cel.InterruptCheckFrequency(celInterruptCheckFrequency))
+			if err != nil {
+				return fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			rule.program = program
+		}
+	}
+	return nil
+}
+
+// policyInput is everything a policy is evaluated against
+type policyInput struct {
+	sbom            map[string]interface{}
+	vulnerabilities []VulnerabilityMatch
+	packages        []PackageRef
+	qualityScore    *float64
+}
+
+// Evaluate checks every rule against the input and collects the violations, CEL rules still
+// running when ctx is done or policyEvalTimeout passes are reported as violations
+func (p *Policy) Evaluate(ctx context.Context, in policyInput) PolicyVerdict {
+	ctx, cancel := context.WithTimeout(ctx, policyEvalTimeout)
+	defer cancel()
+
+	verdict := PolicyVerdict{
+		Policy:         p.Name,
+		Violations:     []PolicyViolation{},
+		RulesEvaluated: len(p.Rules),
+		EvaluatedAt:    time.Now(),
+	}
+
+	for _, rule := range p.Rules {
+		violations, warnings := rule.evaluate(ctx, in)
+		verdict.Violations = append(verdict.Violations, violations...)
+		verdict.Warnings = append(verdict.Warnings, warnings...)
+	}
+
+	verdict.Pass = len(verdict.Violations) == 0
+	verdict.Verdict = "pass"
+	if !verdict.Pass {
+		verdict.Verdict = "fail"
+	}
+	return verdict
+}
+
+// evaluate returns the rule's violations, and warnings for checks it could not make
+func (r PolicyRule) evaluate(ctx context.Context, in policyInput) ([]PolicyViolation, []string) {
+	var violations []PolicyViolation
+	var warnings []string
+	violate := func(subject string, message string) {
+		violations = append(violations, PolicyViolation{
+			Rule:        r.Name,
+			Description: r.Description,
+			Subject:     subject,
+			Message:     message,
+		})
+	}
+
+	switch r.Scope {
+	case ScopeVulnerability:
+		for _, m := range in.vulnerabilities {
+			subject := fmt.Sprintf("%s in %s@%s", m.ID, m.Package.Name, m.Package.Version)
+			if r.program != nil {
+				r.evalCEL(ctx, map[string]interface{}{"vuln": vulnerabilityActivation(m), "sbom": in.sbom}, subject, violate)
+				continue
+			}
+			if len(r.Severity) > 0 && !containsFold(r.Severity, m.Severity) {
+				continue
+			}
+			if r.FixAvailable != nil && *r.FixAvailable != (len(m.FixedVersions) > 0) {
+				continue
+			}
+			message := fmt.Sprintf("%s severity vulnerability", m.Severity)
+			if len(m.FixedVersions) > 0 {
+				message += ", fixed in " + strings.Join(m.FixedVersions, ", ")
+			}
+			violate(subject, message)
+		}
+	case ScopePackage:
+		for _, p := range in.packages {
+			subject := fmt.Sprintf("%s@%s", p.Name, p.Version)
+			if r.program != nil {
+				r.evalCEL(ctx, map[string]interface{}{"pkg": packageActivation(p), "sbom": in.sbom}, subject, violate)
+				continue
+			}
+			for _, license := range p.Licenses {
+				if denied := deniedLicense(license, r.Licenses); denied != "" {
+					violate(subject, fmt.Sprintf("license %s is not allowed (%s)", license, denied))
+					break
+				}
+			}
+		}
+	case ScopeSBOM:
+		if r.program != nil {
+			r.evalCEL(ctx, map[string]interface{}{"sbom": in.sbom}, "sbom", violate)
+			break
+		}
+		if r.MinQualityScore != nil {
+			// A score that couldn't be computed is unknown rather than failing, sbomqs is optional
+			switch {
+			case in.qualityScore == nil:
+				warnings = append(warnings, fmt.Sprintf("rule %s skipped: quality score unavailable", r.Name))
+			case *in.qualityScore < *r.MinQualityScore:
+				violate("sbom", fmt.Sprintf("quality score %.1f is below %.1f", *in.qualityScore, *r.MinQualityScore))
+			}
+		}
+		if r.MaxVulnerabilities != nil && len(in.vulnerabilities) > *r.MaxVulnerabilities {
+			violate("sbom", fmt.Sprintf("%d vulnerabilities exceed the limit of %d", len(in.vulnerabilities), *r.MaxVulnerabilities))
+		}
+	}
+	return violations, warnings
+}
+
+// evalCEL runs the rule's expression, treating evaluation errors as violations so a broken rule never passes silently
+func (r PolicyRule) evalCEL(ctx context.Context, activation map[string]interface{}, subject string, violate func(string, string)) {
+	out, _, err := r.program.ContextEval(ctx, activation)
+	if err != nil {
+		violate(subject, fmt.Sprintf("rule could not be evaluated: %v", err))
+		return
+	}
+	if denied, ok := out.Value().(bool); !ok {
+		violate(subject, fmt.Sprintf("rule returned %v instead of a bool", out.Value()))
+	} else if denied {
+		violate(subject, fmt.Sprintf("matched %s", r.CEL))
+	}
+}
+
+func vulnerabilityActivation(m VulnerabilityMatch) map[string]interface{} {
+	maxCVSS := 0.0
+	for _, c := range m.CVSS {
+		if c.BaseScore > maxCVSS {
+			maxCVSS = c.BaseScore
+		}
+	}
+	return map[string]interface{}{
+		"id":            m.ID,
+		"severity":      strings.ToLower(m.Severity),
+		"fixAvailable":  len(m.FixedVersions) > 0,
+		"fixedVersions": stringList(m.FixedVersions),
+		"fixState":      m.FixState,
+		"cvss":          maxCVSS,
+		"namespace":     m.Namespace,
+		"package":       packageActivation(m.Package),
+	}
+}
+
+func packageActivation(p PackageRef) map[string]interface{} {
+	return map[string]interface{}{
+		"name":     p.Name,
+		"version":  p.Version,
+		"type":     p.Type,
+		"purl":     p.PURL,
+		"licenses": stringList(p.Licenses),
+	}
+}
+
+// stringList never returns nil so CEL sees an empty list rather than null
+func stringList(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedLicense returns the denied license an expression refers to. A denied ID
+// also covers its -only, -or-later and + variants, so GPL-3.0 matches GPL-3.0-only.
+func deniedLicense(expression string, denied []string) string {
+	tokens := strings.FieldsFunc(expression, func(r rune) bool {
+		return r == ' ' || r == '(' || r == ')' || r == ','
+	})
+	for _, token := range tokens {
+		for _, d := range denied {
+			t, d2 := strings.ToLower(token), strings.ToLower(d)
+			if t == d2 || t == d2+"+" || strings.HasPrefix(t, d2+"-") {
+				return d
+			}
+		}
+	}
+	return ""
+}
+
+// policyInputFor gathers the stored SBOM, its packages, every vulnerability matched in it and the
+// latest quality score. Stored scans may have been filtered by severity, fix state or request ignore
+// rules, so the SBOM is matched again with only the configured ignore rules applied.
+func policyInputFor(ctx context.Context, id string) (policyInput, error) {
+	rec, scans, err := store.GetSBOM(ctx, id)
+	if err != nil {
+		return policyInput{}, err
+	}
+	doc, err := loadStoredSBOM(id)
+	if err != nil {
+		return policyInput{}, err
+	}
+
+	in := policyInput{}
+	for _, group := range groupPackages(doc) {
+		in.packages = append(in.packages, uniquePackageRefs(group)...)
+	}
+
+	matches, err := matcher.Match(ctx, rec.File)
+	if err != nil {
+		return policyInput{}, err
+	}
+	in.vulnerabilities, _ = fullScanOptions().Apply(matches, time.Now())
+
+	if len(scans) > 0 && scans[0].QualityScore != nil {
+		in.qualityScore = scans[0].QualityScore
+	} else if result, err := getQualityScore(rec.File); err == nil {
+		in.qualityScore = qualityScoreValue(result)
+	}
+
+	summary := summarizeSeverities(in.vulnerabilities)
+	severity := make(map[string]interface{}, len(summary))
+	for level, count := range summary {
+		severity[level] = int64(count)
+	}
+	in.sbom = map[string]interface{}{
+		"id":                 rec.ID,
+		"source":             rec.Source,
+		"sourceName":         rec.SourceName,
+		"format":             rec.Format,
+		"packageCount":       int64(rec.PackageCount),
+		"vulnerabilityCount": int64(len(in.vulnerabilities)),
+		"severity":           severity,
+		"hasQualityScore":    in.qualityScore != nil,
+		"qualityScore":       0.0,
+	}
+	if in.qualityScore != nil {
+		in.sbom["qualityScore"] = *in.qualityScore
+	}
+	return in, nil
+}
+
+// Global policy loaded from the policy file
+var policy *Policy
+
+// evaluatePolicyHandler evaluates a stored SBOM against the server policy, or a policy
+// posted in the request body, and answers 200 on pass and 422 on fail for CI gates
+func evaluatePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	active := policy
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPolicySize))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		active, err = parsePolicy(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	in, err := policyInputFor(r.Context(), id)
+	if err != nil {
+		logger.Log(fmt.Sprintf("Error evaluating policy for SBOM %s: %v", id, err))
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrSBOMNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	verdict := active.Evaluate(r.Context(), in)
+	verdict.SBOMID = id
+	logger.Log(fmt.Sprintf("Policy %s %s for SBOM %s with %d violations", verdict.Policy, verdict.Verdict, id, len(verdict.Violations)))
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	if !verdict.Pass {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(verdict)
+}
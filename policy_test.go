@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyCELLimits(t *testing.T) {
+	// Each nested comprehension multiplies the work, this one runs a hundred million iterations
+	list := "[" + strings.Repeat("1, ", 99) + "1]"
+	expensive := strings.ReplaceAll("L.all(a, L.all(b, L.all(c, L.all(d, a + b + c + d >= 0))))", "L", list)
+	policy, err := parsePolicy([]byte(`
+name: limits
+rules:
+  - name: expensive
+    scope: sbom
+    cel: "` + expensive + `"
+`))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+
+	start := time.Now()
+	verdict := policy.Evaluate(context.Background(), policyInput{sbom: map[string]interface{}{}})
+	if elapsed := time.Since(start); elapsed > policyEvalTimeout {
+		t.Errorf("evaluation took %s, longer than the %s timeout", elapsed, policyEvalTimeout)
+	}
+	if verdict.Pass || len(verdict.Violations) != 1 || !strings.Contains(verdict.Violations[0].Message, "could not be evaluated") {
+		t.Fatalf("expected the rule to fail evaluation, got %+v", verdict)
+	}
+}
+
+func TestPolicyCELDeadline(t *testing.T) {
+	policy, err := parsePolicy([]byte(`
+name: deadline
+rules:
+  - name: slow
+    scope: sbom
+    cel: "[1, 2, 3].all(x, x > 0)"
+`))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	verdict := policy.Evaluate(ctx, policyInput{sbom: map[string]interface{}{}})
+	if verdict.Pass {
+		t.Fatalf("expected a canceled evaluation to fail, got %+v", verdict)
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anchore/stereoscope"
+	stereoscopeEvent "github.com/anchore/stereoscope/pkg/event"
+	"github.com/anchore/stereoscope/pkg/image/docker"
+	"github.com/anchore/syft/syft"
+	syftEvent "github.com/anchore/syft/syft/event"
+	"github.com/anchore/syft/syft/event/monitor"
+	"github.com/anchore/syft/syft/sbom"
+	"github.com/gorilla/mux"
+	"github.com/wagoodman/go-partybus"
+	"github.com/wagoodman/go-progress"
+)
+
+// Progress stages reported on a job's event stream
+const (
+	StageQueued      = "queued"
+	StageSource      = "source-resolution"
+	StageImagePull   = "image-pull"
+	StageLayers      = "layers"
+	StageIndexing    = "file-indexing"
+	StageCataloging  = "cataloging"
+	StageCataloger   = "cataloger"
+	StagePackages    = "packages"
+	StageEncoding    = "encoding"
+	StageScan        = "scan"
+	StageQuality     = "quality-score"
+	StageRemediation = "remediation"
+	StageToken       = "token"
+	StageDone        = "done"
+	StageGap         = "gap"
+)
+
+// Progress event statuses
+const (
+	ProgressStarted   = "started"
+	ProgressRunning   = "running"
+	ProgressCompleted = "completed"
+	ProgressFailed    = "failed"
+)
+
+const progressPollInterval = 250 * time.Millisecond
+
+// progressBufferSize is how many events a subscriber may fall behind before it is disconnected,
+// enough for the token bursts of a fast model
+const progressBufferSize = 256
+
+// ProgressEvent is one step reported on a job's event stream
+type ProgressEvent struct {
+	Stage   string    `json:"stage"`
+	Status  string    `json:"status"`
+	Message string    `json:"message,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Current int64     `json:"current,omitempty"`
+	Total   int64     `json:"total,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// ProgressStream records the events of one job and fans them out to subscribers.
+// A nil stream is valid and discards everything, so callers never need to check.
+type ProgressStream struct {
+	mu          sync.Mutex
+	events      []ProgressEvent
+	subscribers map[chan ProgressEvent]struct{}
+	closed      bool
+}
+
+// NewProgressStream creates an empty stream
+func NewProgressStream() *ProgressStream {
+	return &ProgressStream{subscribers: make(map[chan ProgressEvent]struct{})}
+}
+
+// Publish appends an event and delivers it to every subscriber
+func (s *ProgressStream) Publish(e ProgressEvent) {
+	if s == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.events = append(s.events, e)
+	for ch := range s.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// A subscriber that can't keep up is disconnected rather than left with a silent hole
+			// or allowed to block the job, the gap event tells it to reconnect and replay the history
+			s.disconnect(ch)
+		}
+	}
+}
+
+// disconnect ends a lagging subscription with a gap event, dropping the oldest buffered
+// event if needed to make room for it. The caller must hold s.mu.
+func (s *ProgressStream) disconnect(ch chan ProgressEvent) {
+	delete(s.subscribers, ch)
+	gap := ProgressEvent{Stage: StageGap, Status: ProgressFailed, Message: "events were missed, reconnect to replay them", Time: time.Now()}
+	for {
+		select {
+		case ch <- gap:
+			close(ch)
+			return
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+		}
+	}
+}
+
+// Step is shorthand for publishing an event without counters
+func (s *ProgressStream) Step(stage string, status string, message string) {
+	s.Publish(ProgressEvent{Stage: stage, Status: status, Message: message})
+}
+
+// Subscribe returns the events published so far and a channel for the rest.
+// The channel is closed when the stream closes, or after a gap event when the
+// subscriber falls behind; call the returned func to stop early.
+func (s *ProgressStream) Subscribe() ([]ProgressEvent, <-chan ProgressEvent, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := append([]ProgressEvent(nil), s.events...)
+	ch := make(chan ProgressEvent, progressBufferSize)
+	if s.closed {
+		close(ch)
+		return history, ch, func() {}
+	}
+	s.subscribers[ch] = struct{}{}
+
+	return history, ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends the stream for all subscribers
+func (s *ProgressStream) Close() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for ch := range s.subscribers {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Trim drops the history of a closed stream except its last event, so late subscribers
+// still see how it ended without the stream holding on to every event
+func (s *ProgressStream) Trim() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed || len(s.events) == 0 {
+		return
+	}
+	s.events = []ProgressEvent{s.events[len(s.events)-1]}
+}
+
+// Done reports whether the stream has been closed
+func (s *ProgressStream) Done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+type progressKey struct{}
+
+// withProgress attaches a progress stream to ctx
+func withProgress(ctx context.Context, stream *ProgressStream) context.Context {
+	return context.WithValue(ctx, progressKey{}, stream)
+}
+
+// progressFrom returns the stream attached to ctx, or nil
+func progressFrom(ctx context.Context) *ProgressStream {
+	stream, _ := ctx.Value(progressKey{}).(*ProgressStream)
+	return stream
+}
+
+// reportPackageCounts publishes the number of packages each cataloger found
+func reportPackageCounts(stream *ProgressStream, s *sbom.SBOM) {
+	counts := make(map[string]int64)
+	for p := range s.Artifacts.Packages.Enumerate() {
+		counts[p.FoundBy]++
+	}
+	for name, count := range counts {
+		stream.Publish(ProgressEvent{Stage: StagePackages, Status: ProgressRunning, Name: name, Current: count})
+	}
+	stream.Publish(ProgressEvent{
+		Stage:   StagePackages,
+		Status:  ProgressCompleted,
+		Message: fmt.Sprintf("%d packages found", s.Artifacts.Packages.PackageCount()),
+		Current: int64(s.Artifacts.Packages.PackageCount()),
+	})
+}
+
+// ProgressRouter forwards syft and stereoscope bus events to running jobs.
+// Both libraries publish on a single process-wide bus without saying which
+// caller an event belongs to, so library events are only forwarded while
+// exactly one job is cataloging. Concurrent jobs still receive their own stage
+// events and the per-cataloger package summary.
+type ProgressRouter struct {
+	mu      sync.Mutex
+	streams map[*ProgressStream]struct{}
+}
+
+// NewProgressRouter installs a bus for syft and stereoscope and starts routing its events
+func NewProgressRouter() *ProgressRouter {
+	router := &ProgressRouter{streams: make(map[*ProgressStream]struct{})}
+
+	bus := partybus.NewBus()
+	syft.SetBus(bus)
+	stereoscope.SetBus(bus)
+
+	sub := bus.Subscribe()
+	go func() {
+		for e := range sub.Events() {
+			router.handle(e)
+		}
+	}()
+	return router
+}
+
+// Track marks the stream as cataloging until the returned func is called
+func (r *ProgressRouter) Track(stream *ProgressStream) func() {
+	if r == nil || stream == nil {
+		return func() {}
+	}
+
+	r.mu.Lock()
+	r.streams[stream] = struct{}{}
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.streams, stream)
+		r.mu.Unlock()
+	}
+}
+
+// target returns the only cataloging stream, or nil when attribution is ambiguous
+func (r *ProgressRouter) target() *ProgressStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.streams) != 1 {
+		return nil
+	}
+	for stream := range r.streams {
+		return stream
+	}
+	return nil
+}
+
+func (r *ProgressRouter) handle(e partybus.Event) {
+	stream := r.target()
+	if stream == nil {
+		return
+	}
+
+	switch e.Type {
+	case stereoscopeEvent.PullDockerImage:
+		status, ok := e.Value.(*docker.PullStatus)
+		if !ok {
+			return
+		}
+		stream.Step(StageImagePull, ProgressStarted, fmt.Sprintf("pulling %v", e.Source))
+		go func() {
+			for !status.Complete() && !stream.Done() {
+				time.Sleep(progressPollInterval)
+			}
+			stream.Step(StageImagePull, ProgressCompleted, fmt.Sprintf("pulled %v", e.Source))
+		}()
+	case stereoscopeEvent.FetchImage:
+		if p, ok := e.Value.(progress.StagedProgressable); ok {
+			go watchProgress(stream, StageImagePull, fmt.Sprint(e.Source), p, true)
+		}
+	case stereoscopeEvent.ReadImage:
+		if p, ok := e.Value.(progress.Progressable); ok {
+			go watchProgress(stream, StageLayers, "reading and squashing layers", p, true)
+		}
+	case syftEvent.FileIndexingStarted:
+		if p, ok := e.Value.(progress.Progressable); ok {
+			go watchProgress(stream, StageIndexing, fmt.Sprint(e.Source), p, false)
+		}
+	case syftEvent.PullSourceStarted:
+		if p, ok := e.Value.(progress.Progressable); ok {
+			go watchProgress(stream, StageImagePull, taskName(e.Source), p, true)
+		}
+	case syftEvent.CatalogerTaskStarted:
+		task, ok := e.Source.(monitor.GenericTask)
+		if !ok {
+			return
+		}
+		p, ok := e.Value.(progress.Progressable)
+		if !ok {
+			return
+		}
+		switch {
+		case task.ID == monitor.TopLevelCatalogingTaskID:
+			go watchProgress(stream, StageCataloging, task.Title.Default, p, true)
+		case task.ParentID == monitor.PackageCatalogingTaskID:
+			go watchProgress(stream, StageCataloger, task.ID, p, false)
+		}
+	}
+}
+
+func taskName(source interface{}) string {
+	if task, ok := source.(monitor.GenericTask); ok {
+		return task.Title.Default
+	}
+	return fmt.Sprint(source)
+}
+
+// watchProgress polls a library progress value and republishes it until it completes
+func watchProgress(stream *ProgressStream, stage string, name string, p progress.Progressable, reportEach bool) {
+	stream.Publish(ProgressEvent{Stage: stage, Status: ProgressStarted, Name: name, Total: p.Size()})
+
+	var last int64 = -1
+	for !stream.Done() {
+		if progress.IsCompleted(p) {
+			stream.Publish(ProgressEvent{Stage: stage, Status: ProgressCompleted, Name: name, Current: p.Current(), Total: p.Size()})
+			return
+		}
+		if err := p.Error(); err != nil {
+			stream.Publish(ProgressEvent{Stage: stage, Status: ProgressFailed, Name: name, Message: err.Error()})
+			return
+		}
+		if reportEach && p.Current() != last {
+			last = p.Current()
+			e := ProgressEvent{Stage: stage, Status: ProgressRunning, Name: name, Current: last, Total: p.Size()}
+			if s, ok := p.(progress.Stager); ok {
+				e.Message = s.Stage()
+			}
+			stream.Publish(e)
+		}
+		time.Sleep(progressPollInterval)
+	}
+}
+
+// Global progress router
+var progressRouter *ProgressRouter
+
+// jobEventsHandler streams a job's progress as Server-Sent Events
+func jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	stream, err := jobs.Events(mux.Vars(r)["id"])
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrJobNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	history, events, unsubscribe := stream.Subscribe()
+	defer unsubscribe()
+
+	for _, e := range history {
+		writeSSE(w, e)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			writeSSE(w, e)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSSE writes one event in text/event-stream framing
+func writeSSE(w http.ResponseWriter, e ProgressEvent) {
+	writeSSEData(w, e.Stage, e)
+}
+
+// writeSSEData writes a named event with a JSON payload in text/event-stream framing
+func writeSSEData(w http.ResponseWriter, event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// wantsStream reports whether the client asked for Server-Sent Events, with ?stream=true or the Accept header
+func wantsStream(r *http.Request) bool {
+	return r.URL.Query().Get("stream") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// serveStream runs work with a progress stream attached to its context and relays the progress,
+// including LLM tokens, as Server-Sent Events. No token is dropped silently: a client that falls
+// behind gets a "gap" event and no further tokens, and the stream always ends with a "result"
+// event carrying the complete response body work returns, or an "error" event.
+func serveStream(w http.ResponseWriter, r *http.Request, work func(ctx context.Context) (interface{}, error)) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	stream := NewProgressStream()
+	_, events, unsubscribe := stream.Subscribe()
+	defer unsubscribe()
+
+	type outcome struct {
+		body interface{}
+		err  error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		body, err := work(withProgress(r.Context(), stream))
+		stream.Close()
+		done <- outcome{body, err}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	// The channel closes once work returns, after the events published before it, or early
+	// after a gap event, in which case the result is still sent when work returns
+	for events != nil {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			writeSSE(w, e)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	result := <-done
+	if result.err != nil {
+		writeSSEData(w, "error", map[string]string{"error": result.err.Error()})
+	} else {
+		writeSSEData(w, "result", result.body)
+	}
+	flusher.Flush()
+}
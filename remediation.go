@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/anchore/packageurl-go"
+	"github.com/anchore/syft/syft/pkg"
+	"github.com/hashicorp/go-version"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// basicEngine names the rule-based remediation used when no LLM is available
+const basicEngine = "basic"
+
+// RemediationStep is the upgrade that fixes the vulnerabilities of one package
+type RemediationStep struct {
+	Package         PackageRef `json:"package"`
+	Ecosystem       string     `json:"ecosystem"`
+	FixedVersion    string     `json:"fixedVersion,omitempty"`
+	Vulnerabilities []string   `json:"vulnerabilities,omitempty"`
+	// Unfixed lists vulnerabilities of the package that the upgrade doesn't fix
+	Unfixed []string `json:"unfixed,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Note    string   `json:"note,omitempty"`
+}
+
+// RemediationGroup is the upgrades for the packages of one ecosystem found in one manifest
+type RemediationGroup struct {
+	Ecosystem string `json:"ecosystem"`
+	// Label describes the packages, such as "Python package"
+	Label string `json:"label"`
+	// Location is the manifest or lockfile the packages were found in, empty for OS packages
+	Location string            `json:"location,omitempty"`
+	Steps    []RemediationStep `json:"steps"`
+}
+
+// describe names the group in scripts and prompts
+func (g RemediationGroup) describe() string {
+	location := g.Location
+	if location == "" {
+		location = "system packages"
+	}
+	return fmt.Sprintf("%s (%s): %s", g.Ecosystem, g.Label, location)
+}
+
+// packageManager knows how to pin one package to a version
+type packageManager struct {
+	Name  string
+	Label string
+	// System package managers upgrade the whole image, so their packages aren't grouped by location
+	System  bool
+	upgrade func(p PackageRef, version string) (command string, note string)
+}
+
+// packageManagers maps syft package types to the tool that upgrades them
+var packageManagers = map[pkg.Type]packageManager{
+	pkg.PythonPkg: {"pip", "Python package", false, func(p PackageRef, v string) (string, string) {
+		return shellCommand("pip", "install", p.Name+"=="+v), ""
+	}},
+	pkg.NpmPkg: {"npm", "Node.js package", false, func(p PackageRef, v string) (string, string) {
+		return shellCommand("npm", "install", p.Name+"@"+v), ""
+	}},
+	pkg.GoModulePkg: {"go", "Go package", false, func(p PackageRef, v string) (string, string) {
+		if p.Name == "stdlib" {
+			return "", fmt.Sprintf("rebuild with Go %s or later", strings.TrimPrefix(v, "go"))
+		}
+		return shellCommand("go", "get", p.Name+"@v"+strings.TrimPrefix(v, "v")), ""
+	}},
+	pkg.JavaPkg:          {"maven", "Java package", false, mavenUpgrade},
+	pkg.JenkinsPluginPkg: {"maven", "Java package", false, mavenUpgrade},
+	pkg.GemPkg: {"bundler", "Ruby gem", false, func(p PackageRef, v string) (string, string) {
+		return shellCommand("bundle", "update", "--conservative", p.Name), fmt.Sprintf("requires %s >= %s in the Gemfile", p.Name, v)
+	}},
+	pkg.RustPkg: {"cargo", "Rust crate", false, func(p PackageRef, v string) (string, string) {
+		return shellCommand("cargo", "update", "-p", p.Name, "--precise", v), ""
+	}},
+	pkg.ApkPkg: {"apk", "Alpine package", true, func(p PackageRef, v string) (string, string) {
+		return shellCommand("apk", "add", "--upgrade", p.Name+">="+v), ""
+	}},
+	pkg.DebPkg: {"apt", "Debian package", true, func(p PackageRef, v string) (string, string) {
+		return shellCommand("apt-get", "install", "-y", "--only-upgrade", p.Name+"="+v), ""
+	}},
+	pkg.RpmPkg: {"dnf", "RPM package", true, func(p PackageRef, v string) (string, string) {
+		return shellCommand("dnf", "upgrade", "-y", p.Name+"-"+v), ""
+	}},
+}
+
+// shellCommand joins the words of a command, each quoted for bash so package names and versions
+// read from an SBOM can't inject shell syntax. It returns "" when a word can't be quoted.
+func shellCommand(words ...string) string {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		q, err := syntax.Quote(word, syntax.LangBash)
+		if err != nil {
+			return ""
+		}
+		quoted = append(quoted, q)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// managerFor finds the package manager from the syft package type, then the PURL type
+func managerFor(p PackageRef) (packageManager, bool) {
+	if manager, ok := packageManagers[pkg.Type(p.Type)]; ok {
+		return manager, true
+	}
+	manager, ok := packageManagers[pkg.TypeFromPURL(p.PURL)]
+	return manager, ok
+}
+
+// mavenUpgrade pins a dependency with the versions plugin
+func mavenUpgrade(p PackageRef, v string) (string, string) {
+	groupID, artifactID := "", p.Name
+	if purl, err := packageurl.FromString(p.PURL); err == nil {
+		groupID, artifactID = purl.Namespace, purl.Name
+	}
+	if groupID == "" {
+		return "", fmt.Sprintf("upgrade %s to %s in the POM, the group ID is unknown", artifactID, v)
+	}
+	return shellCommand("mvn", "versions:use-dep-version", "-Dincludes="+groupID+":"+artifactID, "-DdepVersion="+v, "-DforceVersion=true"), ""
+}
+
+// planRemediation turns matches into one pinned upgrade per vulnerable package, choosing the
+// lowest version that fixes every fixable vulnerability, grouped by ecosystem and manifest
+func planRemediation(matches []VulnerabilityMatch) []RemediationGroup {
+	groupIndex := make(map[string]int)
+	stepIndex := make(map[string]int)
+	var groups []RemediationGroup
+	for _, m := range matches {
+		manager, known := managerFor(m.Package)
+		group := RemediationGroup{Ecosystem: manager.Name, Label: manager.Label}
+		if !known {
+			group.Ecosystem, group.Label = m.Package.Type, "package"
+		}
+		if !manager.System && len(m.Locations) > 0 {
+			group.Location = m.Locations[0]
+		}
+
+		groupKey := group.Ecosystem + "|" + group.Location
+		g, ok := groupIndex[groupKey]
+		if !ok {
+			g = len(groups)
+			groupIndex[groupKey] = g
+			groups = append(groups, group)
+		}
+
+		stepKey := strings.Join([]string{groupKey, m.Package.Type, m.Package.Name, m.Package.Version}, "|")
+		i, ok := stepIndex[stepKey]
+		if !ok {
+			i = len(groups[g].Steps)
+			stepIndex[stepKey] = i
+			groups[g].Steps = append(groups[g].Steps, RemediationStep{Package: m.Package, Ecosystem: group.Ecosystem})
+		}
+
+		step := &groups[g].Steps[i]
+		fix := lowestFix(m.Package.Version, m.FixedVersions)
+		if fix == "" {
+			step.Unfixed = append(step.Unfixed, m.ID)
+			continue
+		}
+		step.Vulnerabilities = append(step.Vulnerabilities, m.ID)
+		if step.FixedVersion == "" || compareVersions(fix, step.FixedVersion) > 0 {
+			step.FixedVersion = fix
+		}
+	}
+
+	for _, group := range groups {
+		for i := range group.Steps {
+			step := &group.Steps[i]
+			if step.FixedVersion == "" {
+				step.Note = "no fix available"
+				continue
+			}
+			manager, ok := managerFor(step.Package)
+			if !ok {
+				step.Note = fmt.Sprintf("upgrade to %s manually, %s packages have no automated upgrade", step.FixedVersion, step.Package.Type)
+				continue
+			}
+			step.Command, step.Note = manager.upgrade(step.Package, step.FixedVersion)
+		}
+		sort.SliceStable(group.Steps, func(i, j int) bool {
+			return group.Steps[i].Package.Name < group.Steps[j].Package.Name
+		})
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Ecosystem != groups[j].Ecosystem {
+			return groups[i].Ecosystem < groups[j].Ecosystem
+		}
+		return groups[i].Location < groups[j].Location
+	})
+	return groups
+}
+
+// lowestFix picks the lowest fixed version above the installed one, "" when none is above it
+func lowestFix(installed string, fixed []string) string {
+	best := ""
+	for _, v := range fixed {
+		if compareVersions(v, installed) <= 0 {
+			continue
+		}
+		if best == "" || compareVersions(v, best) == -1 {
+			best = v
+		}
+	}
+	return best
+}
+
+// versionsIncomparable is returned by compareVersions when either version can't be parsed
+const versionsIncomparable = 2
+
+// compareVersions returns -1, 0 or 1 like strings.Compare, or versionsIncomparable
+func compareVersions(a, b string) int {
+	va, errA := version.NewVersion(a)
+	vb, errB := version.NewVersion(b)
+	if errA != nil || errB != nil {
+		return versionsIncomparable
+	}
+	return va.Compare(vb)
+}
+
+// commentText keeps SBOM values inside a single script comment line
+func commentText(s string) string {
+	return strings.NewReplacer("\n", " ", "\r", " ").Replace(s)
+}
+
+// packageTypeLabels lists the kinds of vulnerable packages in the groups, such as "Python package, Debian package"
+func packageTypeLabels(groups []RemediationGroup) string {
+	var labels []string
+	for _, g := range groups {
+		labels = append(labels, g.Label)
+	}
+	if len(labels) == 0 {
+		return "package"
+	}
+	return strings.Join(uniqueSorted(labels), ", ")
+}
+
+// generateBasicRemediation creates a remediation script from the scan results, with a
+// section per ecosystem and manifest, without requiring an LLM or other external services
+func generateBasicRemediation(matches []VulnerabilityMatch) string {
+	lines := []string{
+		"# Remediation script generated from the scan results",
+		"# Please review before executing",
+	}
+
+	for _, group := range planRemediation(matches) {
+		lines = append(lines, "", "# == "+commentText(group.describe())+" ==")
+		for _, step := range group.Steps {
+			subject := fmt.Sprintf("# %s %s", commentText(step.Package.Name), commentText(step.Package.Version))
+			if len(step.Vulnerabilities) > 0 {
+				subject += ": fixes " + strings.Join(step.Vulnerabilities, ", ")
+			} else {
+				subject += ": " + strings.Join(step.Unfixed, ", ")
+			}
+			lines = append(lines, subject)
+			if len(step.Vulnerabilities) > 0 && len(step.Unfixed) > 0 {
+				lines = append(lines, "# not fixed by an upgrade: "+strings.Join(step.Unfixed, ", "))
+			}
+			if step.Note != "" {
+				lines = append(lines, "# "+commentText(step.Note))
+			}
+			if step.Command != "" {
+				lines = append(lines, step.Command)
+			}
+		}
+	}
+
+	return fmt.Sprintf("```bash\n%s\n```", strings.Join(lines, "\n"))
+}
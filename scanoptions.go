@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// IgnorePackage selects the packages an ignore rule applies to, empty fields match anything
+type IgnorePackage struct {
+	Name     string `json:"name,omitempty" yaml:"name"`
+	Version  string `json:"version,omitempty" yaml:"version"`
+	Type     string `json:"type,omitempty" yaml:"type"`
+	Location string `json:"location,omitempty" yaml:"location"`
+}
+
+// IgnoreRule suppresses matching findings until it expires
+type IgnoreRule struct {
+	Vulnerability string        `json:"vulnerability,omitempty" yaml:"vulnerability"`
+	FixState      string        `json:"fixState,omitempty" yaml:"fix-state"`
+	Package       IgnorePackage `json:"package,omitempty" yaml:"package"`
+	Reason        string        `json:"reason,omitempty" yaml:"reason"`
+	Expires       string        `json:"expires,omitempty" yaml:"expires"`
+
+	expiresAt time.Time
+}
+
+// ScanOptions control which vulnerability matches a scan reports
+type ScanOptions struct {
+	MinSeverity    string       `json:"minSeverity,omitempty" yaml:"min-severity"`
+	IncludeUnfixed *bool        `json:"includeUnfixed,omitempty" yaml:"include-unfixed"`
+	Ignore         []IgnoreRule `json:"ignore,omitempty" yaml:"ignore"`
+}
+
+// IgnoredMatch is a match left out of a scan report and why
+type IgnoredMatch struct {
+	VulnerabilityMatch
+	Reason string `json:"reason"`
+}
+
+// loadScanConfig reads the server's default scan options, a missing file means no defaults
+func loadScanConfig(path string) (ScanOptions, error) {
+	var opts ScanOptions
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return opts, nil
+	}
+	if err != nil {
+		return opts, fmt.Errorf("failed to read scan config: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &opts); err != nil {
+		return opts, fmt.Errorf("failed to parse scan config %s: %w", path, err)
+	}
+	if err := opts.validate(); err != nil {
+		return opts, fmt.Errorf("invalid scan config %s: %w", path, err)
+	}
+	return opts, nil
+}
+
+// validate checks the severity, rejects ignore rules without criteria and parses rule expiry dates
+func (o *ScanOptions) validate() error {
+	o.MinSeverity = strings.ToLower(o.MinSeverity)
+	if o.MinSeverity != "" && severityRank(o.MinSeverity) < 0 {
+		return fmt.Errorf("unknown minSeverity %q, allowed values are %s", o.MinSeverity, strings.Join(severityLevels, ", "))
+	}
+
+	for i := range o.Ignore {
+		rule := &o.Ignore[i]
+		if rule.Vulnerability == "" && rule.FixState == "" && rule.Package == (IgnorePackage{}) {
+			return fmt.Errorf("ignore rule %d matches every finding, set vulnerability, fixState or a package field", i+1)
+		}
+		if rule.Package.Location != "" && !doublestar.ValidatePattern(rule.Package.Location) {
+			return fmt.Errorf("ignore rule %d: invalid location glob %q", i+1, rule.Package.Location)
+		}
+		if rule.Expires != "" {
+			expiresAt, err := parseExpiry(rule.Expires)
+			if err != nil {
+				return fmt.Errorf("ignore rule %d: %w", i+1, err)
+			}
+			rule.expiresAt = expiresAt
+		}
+	}
+	return nil
+}
+
+// parseExpiry accepts a date, which expires at the end of that day, or a full timestamp
+func parseExpiry(value string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expires %q, use YYYY-MM-DD or RFC 3339", value)
+	}
+	return t, nil
+}
+
+// merge layers request options over the server defaults, ignore rules from both apply
+func (o ScanOptions) merge(override ScanOptions) ScanOptions {
+	merged := o
+	if override.MinSeverity != "" {
+		merged.MinSeverity = override.MinSeverity
+	}
+	if override.IncludeUnfixed != nil {
+		merged.IncludeUnfixed = override.IncludeUnfixed
+	}
+	merged.Ignore = append(append([]IgnoreRule(nil), o.Ignore...), override.Ignore...)
+	return merged
+}
+
+// fullScanOptions reports every match, fixed or not and of any severity, except those the
+// configured ignore rules accept
+func fullScanOptions() ScanOptions {
+	return ScanOptions{IncludeUnfixed: boolPtr(true), Ignore: scanConfig.Ignore}
+}
+
+// severityRank orders severities with critical highest, -1 for unknown names
+func severityRank(severity string) int {
+	severity = strings.ToLower(severity)
+	for i, level := range severityLevels {
+		if level == severity {
+			return len(severityLevels) - i
+		}
+	}
+	return -1
+}
+
+// Apply splits matches into those to report and those left out by the options
+func (o ScanOptions) Apply(matches []VulnerabilityMatch, now time.Time) ([]VulnerabilityMatch, []IgnoredMatch) {
+	kept := make([]VulnerabilityMatch, 0, len(matches))
+	var ignored []IgnoredMatch
+	for _, m := range matches {
+		if reason := o.ignoreReason(m, now); reason != "" {
+			ignored = append(ignored, IgnoredMatch{VulnerabilityMatch: m, Reason: reason})
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept, ignored
+}
+
+func (o ScanOptions) ignoreReason(m VulnerabilityMatch, now time.Time) string {
+	for _, rule := range o.Ignore {
+		if rule.matches(m, now) {
+			reason := rule.Reason
+			if reason == "" {
+				reason = "matched ignore rule " + rule.describe()
+			}
+			if rule.Expires != "" {
+				reason += " (until " + rule.Expires + ")"
+			}
+			return reason
+		}
+	}
+	if o.MinSeverity != "" {
+		if rank := severityRank(m.Severity); rank < 0 || rank < severityRank(o.MinSeverity) {
+			return fmt.Sprintf("severity %s is below %s", m.Severity, o.MinSeverity)
+		}
+	}
+	if (o.IncludeUnfixed == nil || !*o.IncludeUnfixed) && len(m.FixedVersions) == 0 {
+		return "no fix available"
+	}
+	return ""
+}
+
+func (r IgnoreRule) matches(m VulnerabilityMatch, now time.Time) bool {
+	if !r.expiresAt.IsZero() && !now.Before(r.expiresAt) {
+		return false
+	}
+	if r.Vulnerability != "" && !strings.EqualFold(r.Vulnerability, m.ID) {
+		return false
+	}
+	if r.FixState != "" && !strings.EqualFold(r.FixState, m.FixState) {
+		return false
+	}
+	if r.Package.Name != "" && r.Package.Name != m.Package.Name {
+		return false
+	}
+	if r.Package.Version != "" && r.Package.Version != m.Package.Version {
+		return false
+	}
+	if r.Package.Type != "" && r.Package.Type != m.Package.Type {
+		return false
+	}
+	if r.Package.Location != "" && !matchesAnyLocation(r.Package.Location, m.Locations) {
+		return false
+	}
+	return true
+}
+
+func matchesAnyLocation(pattern string, locations []string) bool {
+	for _, location := range locations {
+		if ok, _ := doublestar.Match(pattern, location); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// describe summarizes the rule's criteria for ignore reasons
+func (r IgnoreRule) describe() string {
+	var parts []string
+	add := func(key, value string) {
+		if value != "" {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	add("vulnerability", r.Vulnerability)
+	add("fix-state", r.FixState)
+	add("package", r.Package.Name)
+	add("version", r.Package.Version)
+	add("type", r.Package.Type)
+	add("location", r.Package.Location)
+	return strings.Join(parts, " ")
+}
+
+// scanMatches matches vulnerabilities in an SBOM file and applies the server defaults and request options
+func scanMatches(ctx context.Context, sbomFile string, opts ScanOptions) ([]VulnerabilityMatch, []IgnoredMatch, error) {
+	matches, err := matcher.Match(ctx, sbomFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	kept, ignored := scanConfig.merge(opts).Apply(matches, time.Now())
+	return kept, ignored, nil
+}
+
+// Global default scan options loaded from the scan config file
+var scanConfig ScanOptions
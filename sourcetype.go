@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/anchore/stereoscope"
+	"github.com/anchore/stereoscope/pkg/image"
+)
+
+// gitSourceType selects a git repository, the one source type syft doesn't provide itself
+const gitSourceType = "git"
+
+// imageSourceType lets syft try every image provider, the guess for sources that are neither
+// a local path nor a git URL
+const imageSourceType = "image"
+
+// Source types read from the local filesystem rather than an image or repository
+var (
+	dirSourceTypes  = []string{"dir", "local-directory"}
+	fileSourceTypes = []string{"file", "local-file"}
+)
+
+// sourceTypes lists the values accepted as the sourceType of a request
+func sourceTypes() []string {
+	return append(allSourceTags(), gitSourceType)
+}
+
+// guessSourceType picks the source type of a request that doesn't name one: a scheme such as
+// registry:alpine wins, then an existing path, then a git URL, anything else is an image.
+// It returns the source without the scheme.
+func guessSourceType(src string) (string, string) {
+	if tag, rest := stereoscope.ExtractSchemeSource(src, allSourceTags()...); tag != "" && !isGitURL(src) {
+		return tag, rest
+	}
+	if info, err := os.Stat(src); err == nil {
+		if info.IsDir() {
+			return "dir", src
+		}
+		return "file", src
+	}
+	if isGitURL(src) {
+		return gitSourceType, src
+	}
+	return imageSourceType, src
+}
+
+// selectSource resolves the source type of a request and checks it against the source and
+// platform, so a mistyped path fails the request instead of turning into a registry pull.
+// It returns the source type and the source without any scheme.
+func selectSource(src string, sourceType string, platform string) (string, string, error) {
+	if sourceType == "" {
+		sourceType, src = guessSourceType(src)
+	} else if !slices.Contains(sourceTypes(), sourceType) {
+		return "", "", fmt.Errorf("unknown source type %q, allowed values are %s", sourceType, strings.Join(sourceTypes(), ", "))
+	}
+
+	local := slices.Contains(dirSourceTypes, sourceType) || slices.Contains(fileSourceTypes, sourceType)
+	switch {
+	case slices.Contains(dirSourceTypes, sourceType):
+		if info, err := os.Stat(src); err != nil || !info.IsDir() {
+			return "", "", fmt.Errorf("source type %s needs an existing directory, %q is not one", sourceType, src)
+		}
+	case slices.Contains(fileSourceTypes, sourceType):
+		if info, err := os.Stat(src); err != nil || !info.Mode().IsRegular() {
+			return "", "", fmt.Errorf("source type %s needs an existing file, %q is not one", sourceType, src)
+		}
+	case sourceType == gitSourceType:
+		if !isGitURL(src) {
+			return "", "", fmt.Errorf("source type git needs an http(s), ssh, git, file or git@host:path URL, %q is not one", src)
+		}
+	}
+
+	if platform != "" {
+		if local || sourceType == gitSourceType {
+			return "", "", fmt.Errorf("platform applies to image sources only, not source type %s", sourceType)
+		}
+		if _, err := image.NewPlatform(platform); err != nil {
+			return "", "", fmt.Errorf("invalid platform, expected os/arch[/variant] such as linux/arm64: %w", err)
+		}
+	}
+	return sourceType, src, nil
+}
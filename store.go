@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/anchore/syft/syft/sbom"
+	"github.com/anchore/syft/syft/source"
+	_ "github.com/glebarez/go-sqlite" // pure-Go driver shared with grype, also required by syft's RPM cataloger
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const defaultHistoryLimit = 100
+
+const storeSchema = `
+CREATE TABLE IF NOT EXISTS sboms (
+	id            TEXT PRIMARY KEY,
+	source        TEXT NOT NULL,
+	source_name   TEXT NOT NULL DEFAULT '',
+	source_digest TEXT NOT NULL DEFAULT '',
+	format        TEXT NOT NULL,
+	file          TEXT NOT NULL,
+	digest        TEXT NOT NULL,
+	package_count INTEGER NOT NULL DEFAULT 0,
+	created_at    TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS scans (
+	id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+	sbom_id             TEXT NOT NULL REFERENCES sboms(id) ON DELETE CASCADE,
+	scan_result         TEXT NOT NULL DEFAULT '',
+	matches             TEXT NOT NULL DEFAULT '',
+	vulnerability_count INTEGER NOT NULL DEFAULT 0,
+	pkg_type            TEXT NOT NULL DEFAULT '',
+	quality_score       REAL,
+	quality_details     TEXT NOT NULL DEFAULT '',
+	remediation         TEXT NOT NULL DEFAULT '',
+	engine              TEXT NOT NULL DEFAULT '',
+	created_at          TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS scans_sbom_id ON scans(sbom_id, created_at);
+
+CREATE TABLE IF NOT EXISTS chat_sessions (
+	id         TEXT PRIMARY KEY,
+	sbom_id    TEXT NOT NULL REFERENCES sboms(id) ON DELETE CASCADE,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS chat_messages (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id TEXT NOT NULL REFERENCES chat_sessions(id) ON DELETE CASCADE,
+	role       TEXT NOT NULL,
+	content    TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS chat_messages_session_id ON chat_messages(session_id, id);
+`
+
+// SBOMRecord is the stored metadata of a generated SBOM
+type SBOMRecord struct {
+	ID           string      `json:"id"`
+	Source       string      `json:"source"`
+	SourceName   string      `json:"sourceName,omitempty"`
+	SourceDigest string      `json:"sourceDigest,omitempty"`
+	Format       string      `json:"format"`
+	File         string      `json:"file"`
+	Digest       string      `json:"digest"`
+	PackageCount int         `json:"packageCount"`
+	CreatedAt    time.Time   `json:"createdAt"`
+	LatestScan   *ScanRecord `json:"latestScan,omitempty"`
+}
+
+// ScanRecord is one stored scan of an SBOM with its quality score and remediation
+type ScanRecord struct {
+	ID                 int64                  `json:"id"`
+	SBOMID             string                 `json:"sbomId"`
+	ScanResult         string                 `json:"scanResult,omitempty"`
+	Matches            []VulnerabilityMatch   `json:"matches,omitempty"`
+	VulnerabilityCount int                    `json:"vulnerabilityCount"`
+	PkgType            string                 `json:"pkgType,omitempty"`
+	QualityScore       *float64               `json:"qualityScore,omitempty"`
+	QualityDetails     map[string]interface{} `json:"qualityDetails,omitempty"`
+	Remediation        string                 `json:"remediation,omitempty"`
+	Engine             string                 `json:"engine,omitempty"`
+	CreatedAt          time.Time              `json:"createdAt"`
+}
+
+// HistoryEntry is a compact scan record used for trend views
+type HistoryEntry struct {
+	SBOMID             string         `json:"sbomId"`
+	Source             string         `json:"source"`
+	PackageCount       int            `json:"packageCount"`
+	VulnerabilityCount int            `json:"vulnerabilityCount"`
+	SeveritySummary    map[string]int `json:"severitySummary,omitempty"`
+	QualityScore       *float64       `json:"qualityScore,omitempty"`
+	CreatedAt          time.Time      `json:"createdAt"`
+}
+
+// Store is the SQLite-backed repository of generated SBOMs and their scans
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore opens (or creates) the SQLite database at path and applies the schema
+func NewStore(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	// SQLite allows a single writer, serialize access instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(storeSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to apply database schema: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// SaveSBOM records a newly generated SBOM
+func (s *Store) SaveSBOM(ctx context.Context, rec SBOMRecord) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO sboms (id, source, source_name, source_digest, format, file, digest, package_count, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.ID, rec.Source, rec.SourceName, rec.SourceDigest, rec.Format, rec.File, rec.Digest, rec.PackageCount, rec.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record SBOM %s: %w", rec.ID, err)
+	}
+	return nil
+}
+
+// SaveScan records a scan of a stored SBOM
+func (s *Store) SaveScan(ctx context.Context, rec ScanRecord) (int64, error) {
+	details := ""
+	if rec.QualityDetails != nil {
+		b, err := json.Marshal(rec.QualityDetails)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode quality details: %w", err)
+		}
+		details = string(b)
+	}
+
+	matches := ""
+	if rec.Matches != nil {
+		b, err := json.Marshal(rec.Matches)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode vulnerability matches: %w", err)
+		}
+		matches = string(b)
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO scans (sbom_id, scan_result, matches, vulnerability_count, pkg_type, quality_score, quality_details, remediation, engine, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.SBOMID, rec.ScanResult, matches, rec.VulnerabilityCount, rec.PkgType, rec.QualityScore, details, rec.Remediation, rec.Engine, rec.CreatedAt.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to record scan for SBOM %s: %w", rec.SBOMID, err)
+	}
+	return res.LastInsertId()
+}
+
+// ListSBOMs returns the most recent SBOMs first, each with its latest scan
+func (s *Store) ListSBOMs(ctx context.Context, limit int) ([]SBOMRecord, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, source, source_name, source_digest, format, file, digest, package_count, created_at
+		 FROM sboms ORDER BY created_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list SBOMs: %w", err)
+	}
+	defer rows.Close()
+
+	records := []SBOMRecord{}
+	for rows.Next() {
+		rec, err := scanSBOMRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list SBOMs: %w", err)
+	}
+
+	for i := range records {
+		scans, err := s.listScans(ctx, records[i].ID, 1, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(scans) > 0 {
+			records[i].LatestScan = &scans[0]
+		}
+	}
+	return records, nil
+}
+
+// GetSBOM returns the SBOM with the given ID and all of its scans, newest first
+func (s *Store) GetSBOM(ctx context.Context, id string) (SBOMRecord, []ScanRecord, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, source, source_name, source_digest, format, file, digest, package_count, created_at
+		 FROM sboms WHERE id = ?`, id)
+	rec, err := scanSBOMRow(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SBOMRecord{}, nil, fmt.Errorf("%w: %s", ErrSBOMNotFound, id)
+	}
+	if err != nil {
+		return SBOMRecord{}, nil, err
+	}
+
+	scans, err := s.listScans(ctx, id, -1, true)
+	if err != nil {
+		return SBOMRecord{}, nil, err
+	}
+	if len(scans) > 0 {
+		rec.LatestScan = &scans[0]
+	}
+	return rec, scans, nil
+}
+
+// DeleteSBOM removes an SBOM and its scans
+func (s *Store) DeleteSBOM(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM sboms WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete SBOM %s: %w", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %s", ErrSBOMNotFound, id)
+	}
+	return nil
+}
+
+// History returns scans across all SBOMs, newest first
+func (s *Store) History(ctx context.Context, limit int) ([]HistoryEntry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT sboms.id, sboms.source, sboms.package_count, scans.vulnerability_count, scans.matches, scans.quality_score, scans.created_at
+		 FROM scans JOIN sboms ON sboms.id = scans.sbom_id
+		 ORDER BY scans.created_at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load history: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var e HistoryEntry
+		var score sql.NullFloat64
+		var matches string
+		if err := rows.Scan(&e.SBOMID, &e.Source, &e.PackageCount, &e.VulnerabilityCount, &matches, &score, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read history: %w", err)
+		}
+		if score.Valid {
+			e.QualityScore = &score.Float64
+		}
+		if matches != "" {
+			var found []VulnerabilityMatch
+			if json.Unmarshal([]byte(matches), &found) == nil {
+				e.SeveritySummary = summarizeSeverities(found)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// CreateChatSession starts an empty chat session about an SBOM
+func (s *Store) CreateChatSession(ctx context.Context, sbomID string) (ChatSession, error) {
+	now := time.Now()
+	session := ChatSession{ID: uuid.NewString(), SBOMID: sbomID, CreatedAt: now, UpdatedAt: now, Messages: []ChatMessage{}}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO chat_sessions (id, sbom_id, created_at, updated_at) VALUES (?, ?, ?, ?)`,
+		session.ID, session.SBOMID, session.CreatedAt, session.UpdatedAt)
+	if err != nil {
+		return ChatSession{}, fmt.Errorf("failed to save chat session: %w", err)
+	}
+	return session, nil
+}
+
+// GetChatSession returns a chat session of an SBOM with its messages, oldest first
+func (s *Store) GetChatSession(ctx context.Context, sbomID string, id string) (ChatSession, error) {
+	session := ChatSession{Messages: []ChatMessage{}}
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, sbom_id, created_at, updated_at FROM chat_sessions WHERE id = ? AND sbom_id = ?`, id, sbomID).
+		Scan(&session.ID, &session.SBOMID, &session.CreatedAt, &session.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ChatSession{}, fmt.Errorf("%w: %s", ErrChatSessionNotFound, id)
+	}
+	if err != nil {
+		return ChatSession{}, fmt.Errorf("failed to read chat session: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT role, content, created_at FROM chat_messages WHERE session_id = ? ORDER BY id`, id)
+	if err != nil {
+		return ChatSession{}, fmt.Errorf("failed to list chat messages: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m ChatMessage
+		if err := rows.Scan(&m.Role, &m.Content, &m.CreatedAt); err != nil {
+			return ChatSession{}, fmt.Errorf("failed to read chat message: %w", err)
+		}
+		session.Messages = append(session.Messages, m)
+	}
+	return session, rows.Err()
+}
+
+// AddChatMessages appends messages to a chat session in one transaction
+func (s *Store) AddChatMessages(ctx context.Context, sessionID string, messages ...ChatMessage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to save chat messages: %w", err)
+	}
+	defer tx.Rollback()
+
+	var updated time.Time
+	for _, m := range messages {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO chat_messages (session_id, role, content, created_at) VALUES (?, ?, ?, ?)`,
+			sessionID, m.Role, m.Content, m.CreatedAt); err != nil {
+			return fmt.Errorf("failed to save chat message: %w", err)
+		}
+		updated = m.CreatedAt
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE chat_sessions SET updated_at = ? WHERE id = ?`, updated, sessionID); err != nil {
+		return fmt.Errorf("failed to update chat session: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (s *Store) listScans(ctx context.Context, sbomID string, limit int, withDetails bool) ([]ScanRecord, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, sbom_id, scan_result, matches, vulnerability_count, pkg_type, quality_score, quality_details, remediation, engine, created_at
+		 FROM scans WHERE sbom_id = ? ORDER BY created_at DESC, id DESC LIMIT ?`, sbomID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list scans: %w", err)
+	}
+	defer rows.Close()
+
+	scans := []ScanRecord{}
+	for rows.Next() {
+		var rec ScanRecord
+		var score sql.NullFloat64
+		var details, matches string
+		if err := rows.Scan(&rec.ID, &rec.SBOMID, &rec.ScanResult, &matches, &rec.VulnerabilityCount, &rec.PkgType, &score, &details, &rec.Remediation, &rec.Engine, &rec.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read scan: %w", err)
+		}
+		if score.Valid {
+			rec.QualityScore = &score.Float64
+		}
+		if withDetails && details != "" {
+			json.Unmarshal([]byte(details), &rec.QualityDetails)
+		}
+		if withDetails && matches != "" {
+			json.Unmarshal([]byte(matches), &rec.Matches)
+		}
+		if !withDetails {
+			rec.ScanResult = ""
+			rec.Remediation = ""
+		}
+		scans = append(scans, rec)
+	}
+	return scans, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSBOMRow(row rowScanner) (SBOMRecord, error) {
+	var rec SBOMRecord
+	err := row.Scan(&rec.ID, &rec.Source, &rec.SourceName, &rec.SourceDigest, &rec.Format, &rec.File, &rec.Digest, &rec.PackageCount, &rec.CreatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return rec, fmt.Errorf("failed to read SBOM: %w", err)
+	}
+	return rec, err
+}
+
+// newSBOMRecord builds the stored metadata for a freshly generated SBOM
+func newSBOMRecord(id string, sourceInput string, file string, outputFormat SBOMFormat, doc *sbom.SBOM, content []byte) SBOMRecord {
+	digest := sha256.Sum256(content)
+	rec := SBOMRecord{
+		ID:           id,
+		Source:       sourceInput,
+		SourceName:   doc.Source.Name,
+		Format:       string(outputFormat.ID),
+		File:         file,
+		Digest:       "sha256:" + hex.EncodeToString(digest[:]),
+		PackageCount: doc.Artifacts.Packages.PackageCount(),
+		CreatedAt:    time.Now(),
+	}
+	if img, ok := doc.Source.Metadata.(source.ImageMetadata); ok {
+		rec.SourceDigest = img.ManifestDigest
+	}
+	return rec
+}
+
+// qualityScoreValue pulls the overall score out of an sbomqs result
+func qualityScoreValue(result map[string]interface{}) *float64 {
+	if score, ok := result["score"].(float64); ok && result["error"] == nil {
+		return &score
+	}
+	// sbomqs --format json reports one entry per scored file
+	if files, ok := result["files"].([]interface{}); ok && len(files) > 0 {
+		if file, ok := files[0].(map[string]interface{}); ok {
+			if score, ok := file["avg_score"].(float64); ok {
+				return &score
+			}
+		}
+	}
+	return nil
+}
+
+// recordScan stores a scan report, logging rather than failing when the store is unavailable
+func recordScan(ctx context.Context, sbomID string, report *ScanReport, engine string) {
+	if store == nil || sbomID == "" || report == nil {
+		return
+	}
+	_, err := store.SaveScan(ctx, ScanRecord{
+		SBOMID:             sbomID,
+		ScanResult:         report.ScanResult,
+		Matches:            report.Vulnerabilities,
+		VulnerabilityCount: len(report.Vulnerabilities),
+		PkgType:            report.PkgType,
+		QualityScore:       qualityScoreValue(report.QualityScore),
+		QualityDetails:     report.QualityScore,
+		Remediation:        report.RemediationScript,
+		Engine:             engine,
+		CreatedAt:          time.Now(),
+	})
+	if err != nil {
+		logger.Log(fmt.Sprintf("Warning: %v", err))
+	}
+}
+
+// Global SBOM repository
+var store *Store
+
+// listSBOMsHandler lists stored SBOMs, newest first
+func listSBOMsHandler(w http.ResponseWriter, r *http.Request) {
+	records, err := store.ListSBOMs(r.Context(), queryLimit(r))
+	if err != nil {
+		logger.Log(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sboms": records,
+	})
+}
+
+// getSBOMHandler returns one stored SBOM with its scans and document
+func getSBOMHandler(w http.ResponseWriter, r *http.Request) {
+	rec, scans, err := store.GetSBOM(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), sbomLookupStatus(err))
+		return
+	}
+
+	content, err := os.ReadFile(rec.File)
+	if err != nil {
+		logger.Log(fmt.Sprintf("Failed to read SBOM file: %v", err))
+		http.Error(w, "Failed to read SBOM file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sbom":     rec,
+		"scans":    scans,
+		"sbomData": string(content),
+	})
+}
+
+// deleteSBOMHandler removes a stored SBOM, its scans and its document
+func deleteSBOMHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := store.DeleteSBOM(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), sbomLookupStatus(err))
+		return
+	}
+	if err := artifacts.Delete(id); err != nil {
+		logger.Log(fmt.Sprintf("Warning: %v", err))
+	}
+
+	logger.Log(fmt.Sprintf("Deleted SBOM %s", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// historyHandler returns scan history across all SBOMs for trend views
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := store.History(r.Context(), queryLimit(r))
+	if err != nil {
+		logger.Log(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"history": entries,
+	})
+}
+
+// queryLimit reads the limit query parameter
+func queryLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return defaultHistoryLimit
+	}
+	return limit
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Kinds of uploaded artifacts, named after the syft source providers that catalog them
+const (
+	UploadDockerArchive = "docker-archive"
+	UploadOCIArchive    = "oci-archive"
+	UploadOCIDir        = "oci-dir"
+	UploadFile          = "file"
+	UploadDir           = "dir"
+)
+
+// uploadTypes are the values accepted in the type field of an upload
+var uploadTypes = []string{UploadDockerArchive, UploadOCIArchive, UploadOCIDir, UploadFile, UploadDir}
+
+// maxUploadEntries bounds the files extracted from an archive, guarding against archives of millions of empty files
+const maxUploadEntries = 100000
+
+// ErrUploadTooLarge is returned when an upload or its extracted contents exceed the limits
+var ErrUploadTooLarge = errors.New("upload too large")
+
+// archiveKind is what an uploaded file turned out to be
+type archiveKind int
+
+const (
+	kindPlain archiveKind = iota
+	kindZip
+	kindTar
+	kindTarGzip
+)
+
+// sniffArchive tells zip, tar and gzip-compressed tar files from other files by their magic bytes
+func sniffArchive(file string) (archiveKind, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return kindPlain, fmt.Errorf("failed to open upload: %w", err)
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		return kindZip, nil
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return kindTarGzip, nil
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return kindTar, nil
+	}
+	return kindPlain, nil
+}
+
+// openTar reads a tar file, decompressing it when it is gzipped. Reading fails with
+// ErrUploadTooLarge once more than limit bytes were decompressed.
+func openTar(file string, kind archiveKind, limit int64) (*tar.Reader, func(), error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open upload: %w", err)
+	}
+	if kind != kindTarGzip {
+		return tar.NewReader(f), func() { f.Close() }, nil
+	}
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to decompress upload: %w", err)
+	}
+	return tar.NewReader(&quotaReader{r: gz, remaining: limit, limit: limit}), func() { gz.Close(); f.Close() }, nil
+}
+
+// quotaReader reads from r until more than limit bytes were read, then fails with ErrUploadTooLarge
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > q.remaining+1 {
+		p = p[:q.remaining+1]
+	}
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, fmt.Errorf("%w: the decompressed archive exceeds %d MB", ErrUploadTooLarge, q.limit>>20)
+	}
+	return n, err
+}
+
+// detectImageTar recognizes docker save tarballs by their manifest.json and OCI image
+// layout archives by their oci-layout file, returning an empty type for other tarballs.
+// At most limit bytes are decompressed and maxUploadEntries entries read.
+func detectImageTar(file string, kind archiveKind, limit int64) (string, error) {
+	tr, closeTar, err := openTar(file, kind, limit)
+	if err != nil {
+		return "", err
+	}
+	defer closeTar()
+
+	ociLayout := false
+	for entries := 0; ; entries++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrUploadTooLarge) {
+			return "", err
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read tar archive: %w", err)
+		}
+		if entries >= maxUploadEntries {
+			return "", fmt.Errorf("%w: the archive has more than %d entries", ErrUploadTooLarge, maxUploadEntries)
+		}
+		switch path.Clean(hdr.Name) {
+		case "manifest.json":
+			// Recent docker save output is also an OCI layout, the docker manifest is the more complete
+			return UploadDockerArchive, nil
+		case "oci-layout":
+			ociLayout = true
+		}
+	}
+	if ociLayout {
+		return UploadOCIArchive, nil
+	}
+	return "", nil
+}
+
+// prepareUpload turns the uploaded file in a workspace into a syft source input of the requested type,
+// detecting the type when it is empty. Archives are unpacked within the room left in the workspace.
+func prepareUpload(ws *Workspace, file string, uploadType string) (string, error) {
+	kind, err := sniffArchive(file)
+	if err != nil {
+		return "", err
+	}
+	limit, err := ws.Remaining()
+	if err != nil {
+		return "", err
+	}
+
+	if uploadType == "" {
+		switch kind {
+		case kindTar, kindTarGzip:
+			if uploadType, err = detectImageTar(file, kind, limit); err != nil {
+				return "", err
+			}
+			if uploadType == "" {
+				uploadType = UploadDir
+			}
+		case kindZip:
+			uploadType = UploadDir
+		default:
+			uploadType = UploadFile
+		}
+	}
+
+	switch uploadType {
+	case UploadFile:
+		return UploadFile + ":" + file, nil
+	case UploadDockerArchive, UploadOCIArchive:
+		if kind == kindTarGzip {
+			// Image tarballs are read in place, so compressed ones are unpacked to a plain tar first
+			if file, err = gunzipFile(file, limit); err != nil {
+				return "", err
+			}
+		} else if kind != kindTar {
+			return "", fmt.Errorf("a %s upload must be a tar archive", uploadType)
+		}
+		return uploadType + ":" + file, nil
+	}
+
+	// Directories, OCI layouts included, are extracted next to the upload, which is then removed
+	if kind == kindPlain {
+		return "", fmt.Errorf("a %s upload must be a zip, tar or tar.gz archive", uploadType)
+	}
+	dir := filepath.Join(ws.Dir, "source")
+	if err := extractArchive(file, kind, dir, limit); err != nil {
+		return "", err
+	}
+	os.Remove(file)
+	dir = archiveRoot(dir)
+
+	_, err = os.Stat(filepath.Join(dir, "oci-layout"))
+	switch {
+	case uploadType == UploadOCIDir && err != nil:
+		return "", errors.New("the oci-dir upload has no oci-layout file")
+	case uploadType == UploadOCIDir, err == nil:
+		return UploadOCIDir + ":" + dir, nil
+	}
+	return UploadDir + ":" + dir, nil
+}
+
+// gunzipFile decompresses a gzip file next to it, removing the compressed file
+func gunzipFile(file string, limit int64) (string, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to open upload: %w", err)
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(in))
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress upload: %w", err)
+	}
+	defer gz.Close()
+
+	target := strings.TrimSuffix(file, filepath.Ext(file))
+	if !strings.HasSuffix(target, ".tar") || target == file {
+		target += ".tar"
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress upload: %w", err)
+	}
+	if err := copyLimited(out, gz, limit); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", fmt.Errorf("failed to decompress upload: %w", err)
+	}
+	os.Remove(file)
+	return target, nil
+}
+
+// extractArchive unpacks a zip or tar archive into dir, writing at most limit bytes.
+// Entries are only ever written inside dir: absolute names and names climbing out with ".."
+// are rejected, and symlinks and hard links are skipped so later entries can't be written through them.
+func extractArchive(archive string, kind archiveKind, dir string, limit int64) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create extraction directory: %w", err)
+	}
+	budget := &extractBudget{bytes: limit, entries: maxUploadEntries, limit: limit}
+
+	if kind == kindZip {
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return fmt.Errorf("failed to read zip archive: %w", err)
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			mode := f.Mode()
+			if mode&os.ModeSymlink != 0 || !(mode.IsDir() || mode.IsRegular()) {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("failed to read %s from zip archive: %w", f.Name, err)
+			}
+			err = extractEntry(dir, f.Name, mode, rc, budget)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tr, closeTar, err := openTar(archive, kind, limit)
+	if err != nil {
+		return err
+	}
+	defer closeTar()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, ErrUploadTooLarge) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+			continue // links, devices and pipes aren't needed to catalog packages
+		}
+		if err := extractEntry(dir, hdr.Name, hdr.FileInfo().Mode(), tr, budget); err != nil {
+			return err
+		}
+	}
+}
+
+// extractBudget is what an extraction may still write
+type extractBudget struct {
+	bytes   int64
+	entries int
+	limit   int64
+}
+
+// extractEntry writes one directory or regular file of an archive under dir
+func extractEntry(dir string, name string, mode os.FileMode, r io.Reader, budget *extractBudget) error {
+	name = strings.TrimPrefix(filepath.FromSlash(name), "."+string(filepath.Separator))
+	if name == "" || name == "." {
+		return nil
+	}
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("archive entry %q points outside the extraction directory", name)
+	}
+	budget.entries--
+	if budget.entries < 0 {
+		return fmt.Errorf("%w: the archive has more than %d entries", ErrUploadTooLarge, maxUploadEntries)
+	}
+
+	target := filepath.Join(dir, name)
+	if mode.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", name, err)
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %w", name, err)
+	}
+	written, err := io.Copy(out, io.LimitReader(r, budget.bytes+1))
+	budget.bytes -= written
+	if err == nil && budget.bytes < 0 {
+		err = fmt.Errorf("%w: the extracted files exceed %d MB", ErrUploadTooLarge, budget.limit>>20)
+	}
+	if closeErr := out.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		if !errors.Is(err, ErrUploadTooLarge) {
+			err = fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// archiveRoot descends into the single top-level directory most source bundles wrap their files in
+func archiveRoot(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 || !entries[0].IsDir() {
+		return dir
+	}
+	return filepath.Join(dir, entries[0].Name())
+}
+
+// copyLimited copies r to w, failing once more than limit bytes were copied
+func copyLimited(w io.Writer, r io.Reader, limit int64) error {
+	n, err := io.Copy(w, io.LimitReader(r, limit+1))
+	if err != nil {
+		return fmt.Errorf("failed to store upload: %w", err)
+	}
+	if n > limit {
+		return fmt.Errorf("%w: the limit is %d MB", ErrUploadTooLarge, limit>>20)
+	}
+	return nil
+}
+
+// uploadLimit is the largest upload accepted, UPLOAD_MAX_MB or the workspace quota if that is lower
+func uploadLimit() int64 {
+	limit := int64(appConfig.UploadMaxMB) << 20
+	if quota := int64(appConfig.WorkspaceQuotaMB) << 20; quota > 0 && (limit <= 0 || quota < limit) {
+		limit = quota
+	}
+	if limit <= 0 {
+		return unlimitedSize
+	}
+	return limit
+}
+
+// uploadForm is what an upload request carries besides the artifact
+type uploadForm struct {
+	filename string
+	kind     string
+	format   string
+}
+
+// receiveUpload streams the artifact of an upload request into the workspace and returns its path.
+// Multipart requests carry it in the file field next to the type and format fields, other requests
+// carry it as the body with the filename, type and format in the query.
+func receiveUpload(r *http.Request, ws *Workspace, limit int64) (string, uploadForm, error) {
+	query := r.URL.Query()
+	form := uploadForm{filename: query.Get("filename"), kind: query.Get("type"), format: query.Get("format")}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		file, err := storeUpload(ws, form.filename, r.Body, limit)
+		return file, form, err
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return "", form, fmt.Errorf("invalid multipart request: %w", err)
+	}
+	file := ""
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", form, fmt.Errorf("invalid multipart request: %w", err)
+		}
+		switch part.FormName() {
+		case "file":
+			if file != "" {
+				return "", form, errors.New("upload one file per request")
+			}
+			form.filename = part.FileName()
+			file, err = storeUpload(ws, form.filename, part, limit)
+		case "type":
+			form.kind, err = readFormValue(part)
+		case "format":
+			form.format, err = readFormValue(part)
+		}
+		part.Close()
+		if err != nil {
+			return "", form, err
+		}
+	}
+	if file == "" {
+		return "", form, errors.New("no file provided, send it in the file field")
+	}
+	return file, form, nil
+}
+
+// readFormValue reads a short multipart text field
+func readFormValue(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, 256))
+	if err != nil {
+		return "", fmt.Errorf("invalid multipart request: %w", err)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// storeUpload writes an uploaded artifact into the workspace under a sanitized name
+func storeUpload(ws *Workspace, filename string, r io.Reader, limit int64) (string, error) {
+	name := filepath.Base(filepath.Clean("/" + strings.ReplaceAll(filename, "\\", "/")))
+	if name == "/" || name == "." {
+		name = "upload"
+	}
+	file := filepath.Join(ws.Dir, name)
+	out, err := os.Create(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to store upload: %w", err)
+	}
+	if err := copyLimited(out, r, limit); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", fmt.Errorf("failed to store upload: %w", err)
+	}
+	return file, nil
+}
+
+// uploadHandler generates an SBOM from an uploaded docker save tarball, OCI image archive or layout,
+// source archive or single file, answering like /generate-sbom
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	limit := uploadLimit()
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20) // room for the multipart framing
+
+	ws, err := workspaces.Create("upload")
+	if err != nil {
+		logger.Log(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Once submitted, the job owns the workspace and removes it when it finishes
+	submitted := false
+	defer func() {
+		if !submitted {
+			ws.Close()
+		}
+	}()
+
+	file, form, err := receiveUpload(r, ws, limit)
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.Is(err, ErrUploadTooLarge) || errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		logger.Log(fmt.Sprintf("Rejected upload: %v", err))
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if form.kind != "" && !slices.Contains(uploadTypes, form.kind) {
+		http.Error(w, fmt.Sprintf("unknown upload type %q, allowed values are %s", form.kind, strings.Join(uploadTypes, ", ")), http.StatusBadRequest)
+		return
+	}
+	outputFormat, negotiated, err := resolveSBOMFormat(form.format, r.Header.Get("Accept"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := filepath.Base(file)
+	sourceInput, err := prepareUpload(ws, file, form.kind)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrUploadTooLarge) || errors.Is(err, ErrWorkspaceQuota) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		logger.Log(fmt.Sprintf("Rejected upload %s: %v", form.filename, err))
+		http.Error(w, err.Error(), status)
+		return
+	}
+	logger.Log(fmt.Sprintf("Received upload %s as %s", form.filename, sourceInput))
+
+	job, err := jobs.Submit(SBOMRequest{
+		Source:      "upload:" + name,
+		SourceInput: sourceInput,
+		SourceName:  name,
+		Workspace:   ws,
+		Format:      outputFormat,
+	})
+	if err != nil {
+		logger.Log(err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	submitted = true
+	serveJobSBOM(w, r, job, negotiated)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEntry is one file, directory or symlink written to a test archive
+type testEntry struct {
+	name     string
+	body     string
+	size     int64 // zero bytes written when set instead of body
+	dir      bool
+	linkname string
+}
+
+// writeTar writes the entries to a tar archive in a temporary directory, gzipped when compress is set
+func writeTar(t *testing.T, entries []testEntry, compress bool) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "upload.tar")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var w io.Writer = f
+	if compress {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		switch {
+		case e.dir:
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		case e.linkname != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.linkname
+		case e.size > 0:
+			hdr.Size = e.size
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.size > 0 {
+			if _, err := io.CopyN(tw, zeroReader{}, e.size); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return file
+}
+
+// writeZip writes the entries to a zip archive in a temporary directory
+func writeZip(t *testing.T, entries []testEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		hdr.SetMode(0644)
+		body := e.body
+		if e.linkname != "" {
+			hdr.SetMode(os.ModeSymlink | 0777)
+			body = e.linkname
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "upload.zip")
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestExtractArchiveRejectsEscapingEntries(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "app/../../evil.txt", "/tmp/evil.txt"} {
+		for _, kind := range []archiveKind{kindTar, kindTarGzip, kindZip} {
+			entries := []testEntry{{name: "app/requirements.txt", body: "flask==1.0\n"}, {name: name, body: "evil\n"}}
+			var archive string
+			if kind == kindZip {
+				archive = writeZip(t, entries)
+			} else {
+				archive = writeTar(t, entries, kind == kindTarGzip)
+			}
+
+			base := t.TempDir()
+			dir := filepath.Join(base, "source")
+			err := extractArchive(archive, kind, dir, 1<<20)
+			if err == nil || !strings.Contains(err.Error(), "outside the extraction directory") {
+				t.Errorf("%s in archive kind %d: expected the entry to be rejected, got %v", name, kind, err)
+			}
+			if _, err := os.Stat(filepath.Join(base, "evil.txt")); err == nil {
+				t.Errorf("%s in archive kind %d: the entry was written outside the extraction directory", name, kind)
+			}
+		}
+	}
+}
+
+func TestExtractArchiveSkipsSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	entries := []testEntry{
+		{name: "link", linkname: outside},
+		{name: "link/evil.txt", body: "evil\n"},
+		{name: "app/passwd", linkname: "/etc/passwd"},
+		{name: "app/requirements.txt", body: "flask==1.0\n"},
+	}
+	for _, kind := range []archiveKind{kindTar, kindZip} {
+		var archive string
+		if kind == kindZip {
+			archive = writeZip(t, entries)
+		} else {
+			archive = writeTar(t, entries, false)
+		}
+
+		dir := filepath.Join(t.TempDir(), "source")
+		if err := extractArchive(archive, kind, dir, 1<<20); err != nil {
+			t.Fatalf("archive kind %d: extraction failed: %v", kind, err)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "evil.txt")); err == nil {
+			t.Errorf("archive kind %d: an entry was written through a symlink", kind)
+		}
+		for _, name := range []string{"link", "app/passwd"} {
+			if info, err := os.Lstat(filepath.Join(dir, name)); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				t.Errorf("archive kind %d: symlink %s was extracted", kind, name)
+			}
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "app", "requirements.txt")); err != nil || string(data) != "flask==1.0\n" {
+			t.Errorf("archive kind %d: expected app/requirements.txt to be extracted, got %q, %v", kind, data, err)
+		}
+	}
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	t.Run("entries", func(t *testing.T) {
+		entries := make([]testEntry, maxUploadEntries+1)
+		for i := range entries {
+			entries[i] = testEntry{name: "dir/", dir: true}
+		}
+		archive := writeTar(t, entries, true)
+		err := extractArchive(archive, kindTarGzip, filepath.Join(t.TempDir(), "source"), 1<<30)
+		if !errors.Is(err, ErrUploadTooLarge) {
+			t.Fatalf("expected ErrUploadTooLarge, got %v", err)
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		for _, kind := range []archiveKind{kindTar, kindTarGzip} {
+			archive := writeTar(t, []testEntry{{name: "a.bin", size: 600 << 10}, {name: "b.bin", size: 600 << 10}}, kind == kindTarGzip)
+			err := extractArchive(archive, kind, filepath.Join(t.TempDir(), "source"), 1<<20)
+			if !errors.Is(err, ErrUploadTooLarge) {
+				t.Errorf("archive kind %d: expected ErrUploadTooLarge, got %v", kind, err)
+			}
+		}
+	})
+}
+
+func TestDetectImageTarLimitsDecompression(t *testing.T) {
+	// A few kilobytes of gzip that decompress to 64 MB
+	archive := writeTar(t, []testEntry{{name: "zeros.bin", size: 64 << 20}, {name: "manifest.json", body: "[]"}}, true)
+
+	if _, err := detectImageTar(archive, kindTarGzip, 1<<20); !errors.Is(err, ErrUploadTooLarge) {
+		t.Fatalf("expected ErrUploadTooLarge, got %v", err)
+	}
+	uploadType, err := detectImageTar(archive, kindTarGzip, 1<<30)
+	if err != nil || uploadType != UploadDockerArchive {
+		t.Fatalf("expected a docker archive within the limit, got %q, %v", uploadType, err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/anchore/syft/syft"
+	"github.com/anchore/syft/syft/source"
+)
+
+// Verification reports what applying the manifest patches to a scratch copy of the source fixed
+type Verification struct {
+	Patched    []string           `json:"patched"`
+	Resolved   []VulnerabilityRef `json:"resolved"`
+	Remaining  []VulnerabilityRef `json:"remaining"`
+	Introduced []VulnerabilityRef `json:"introduced"`
+	Before     map[string]int     `json:"before"`
+	After      map[string]int     `json:"after"`
+	// Diff compares the stored SBOM with the one regenerated from the patched copy
+	Diff SBOMDiff `json:"diff"`
+}
+
+// verifyRemediation copies the source of a stored SBOM to a temporary workspace, applies the
+// manifest patches for the plan, then regenerates the SBOM and rescans it to compare with matches
+func verifyRemediation(ctx context.Context, id string, matches []VulnerabilityMatch, plan []RemediationGroup) (*Verification, []ManifestPatch, error) {
+	rec, _, err := store.GetSBOM(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, cleanup, err := sourceTree(ctx, rec.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cleanup()
+
+	ws, err := workspaces.Create("verify")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ws.Close()
+	workspace := ws.Dir
+
+	logger.Log(fmt.Sprintf("Verifying remediation of SBOM %s in %s", id, workspace))
+	copyCtx, stop := ws.Watch(ctx)
+	err = copyTree(copyCtx, root, workspace)
+	if quotaErr := stop(); quotaErr != nil {
+		err = quotaErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	set := buildPatchSet(workspace, plan)
+	patches, err := set.patches()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := set.write(); err != nil {
+		return nil, nil, err
+	}
+
+	before, err := loadStoredSBOM(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	src, err := openSource(ctx, "dir:"+workspace, source.Alias{}, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer src.Close()
+	after, err := syft.CreateSBOM(ctx, src, catalogConfig())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create SBOM of the patched source: %w", err)
+	}
+
+	sbomFile := filepath.Join(workspace, ".verify-sbom.json")
+	outputFormat, _ := lookupSBOMFormat("syft-json")
+	if err := saveSBOMToFile(after, sbomFile, outputFormat); err != nil {
+		return nil, nil, err
+	}
+	rescanned, _, err := scanMatches(ctx, sbomFile, ScanOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	diff := diffSBOMs(before, after)
+	diff.From, diff.To = id, "patched"
+	diffVulnerabilities(&diff, findingsOf(matches), findingsOf(rescanned))
+
+	verification := &Verification{
+		Patched:    []string{},
+		Resolved:   []VulnerabilityRef{},
+		Remaining:  []VulnerabilityRef{},
+		Introduced: []VulnerabilityRef{},
+		Before:     summarizeSeverities(matches),
+		After:      summarizeSeverities(rescanned),
+		Diff:       diff,
+	}
+	for _, p := range patches {
+		verification.Patched = append(verification.Patched, p.File)
+	}
+	verification.Resolved = append(verification.Resolved, diff.VulnerabilitiesFixed...)
+	verification.Introduced = append(verification.Introduced, diff.VulnerabilitiesIntroduced...)
+	fixed := make(map[string]bool)
+	for _, v := range diff.VulnerabilitiesFixed {
+		fixed[v.ID+"|"+v.Package] = true
+	}
+	for _, v := range findingsOf(matches) {
+		if !fixed[v.ID+"|"+v.Package] {
+			verification.Remaining = append(verification.Remaining, v)
+		}
+	}
+
+	logger.Log(fmt.Sprintf("Verification of SBOM %s: %d resolved, %d remaining, %d introduced",
+		id, len(verification.Resolved), len(verification.Remaining), len(verification.Introduced)))
+	return verification, patches, nil
+}
+
+// copyTree copies the files and directories under src into dst, leaving out .git, until ctx is
+// canceled. A symlink to a file inside src is copied as a regular file and any other symlink is
+// dropped, so patching the copy can never write through a link to a file outside it.
+func copyTree(ctx context.Context, src string, dst string) error {
+	realSrc, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", src, err)
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case d.IsDir():
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return nil // dangling links have nothing to copy
+			}
+			inside, err := filepath.Rel(realSrc, resolved)
+			if err != nil || !filepath.IsLocal(inside) {
+				return nil
+			}
+			if info, err := os.Stat(resolved); err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			return copyFile(resolved, target)
+		case d.Type().IsRegular():
+			return copyFile(path, target)
+		}
+		return nil // sockets, devices and pipes aren't needed to catalog packages
+	})
+}
+
+// copyFile copies a regular file, keeping its permissions
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyTreeSymlinks(t *testing.T) {
+	base := t.TempDir()
+	outside := filepath.Join(base, "outside.txt")
+	if err := os.WriteFile(outside, []byte("secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(base, "src")
+	if err := os.MkdirAll(filepath.Join(src, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "app", "package.json"), []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"absolute.json":        outside,
+		"app/climbing.json":    "../../outside.txt",
+		"app/inside.json":      "package.json",
+		"app/dir":              "..",
+		"app/dangling.json":    "missing.json",
+		"Dockerfile":           outside,
+		"app/requirements.txt": "../app/package.json",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(src, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := t.TempDir()
+	if err := copyTree(context.Background(), src, dst); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+
+	for _, name := range []string{"absolute.json", "app/climbing.json", "app/dir", "app/dangling.json", "Dockerfile"} {
+		if _, err := os.Lstat(filepath.Join(dst, name)); err == nil {
+			t.Errorf("expected link %s to be dropped", name)
+		}
+	}
+	for _, name := range []string{"app/inside.json", "app/requirements.txt"} {
+		info, err := os.Lstat(filepath.Join(dst, name))
+		if err != nil {
+			t.Errorf("expected link %s to be copied: %v", name, err)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			t.Errorf("expected %s to be copied as a regular file, got %s", name, info.Mode())
+		}
+	}
+}
+
+func TestPatchSetWriteRefusesSymlinks(t *testing.T) {
+	base := t.TempDir()
+	outside := filepath.Join(base, "outside.txt")
+	if err := os.WriteFile(outside, []byte("requests==1.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "requirements.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	set := newPatchSet(root)
+	set.files["requirements.txt"] = &patchedFile{
+		original: "requests==1.0\n",
+		lines:    []string{"requests==2.0", ""},
+		packages: []string{"requests@2.0"},
+	}
+	if err := set.write(); err == nil {
+		t.Fatal("expected writing through a symlink to fail")
+	}
+	data, err := os.ReadFile(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "requests==1.0\n" {
+		t.Errorf("file outside the root was changed to %q", data)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anchore/clio"
+	"github.com/anchore/grype/grype"
+	"github.com/anchore/grype/grype/db/v6/distribution"
+	"github.com/anchore/grype/grype/db/v6/installation"
+	grypematcher "github.com/anchore/grype/grype/matcher"
+	grypepkg "github.com/anchore/grype/grype/pkg"
+	"github.com/anchore/grype/grype/vulnerability"
+)
+
+// CVSSScore is one CVSS assessment of a vulnerability
+type CVSSScore struct {
+	Version   string  `json:"version"`
+	Vector    string  `json:"vector"`
+	BaseScore float64 `json:"baseScore"`
+	Source    string  `json:"source,omitempty"`
+}
+
+// VulnerabilityMatch is one vulnerability matched against a package in an SBOM
+type VulnerabilityMatch struct {
+	ID            string      `json:"id"`
+	Severity      string      `json:"severity"`
+	Package       PackageRef  `json:"package"`
+	FixedVersions []string    `json:"fixedVersions,omitempty"`
+	FixState      string      `json:"fixState,omitempty"`
+	CVSS          []CVSSScore `json:"cvss,omitempty"`
+	Namespace     string      `json:"namespace,omitempty"`
+	DataSource    string      `json:"dataSource,omitempty"`
+	URLs          []string    `json:"urls,omitempty"`
+	Locations     []string    `json:"locations,omitempty"`
+}
+
+// severityLevels are grype's severities from most to least severe
+var severityLevels = []string{"critical", "high", "medium", "low", "negligible", "unknown"}
+
+// summarizeSeverities counts matches per severity, always reporting every level
+func summarizeSeverities(matches []VulnerabilityMatch) map[string]int {
+	summary := make(map[string]int, len(severityLevels))
+	for _, level := range severityLevels {
+		summary[level] = 0
+	}
+	for _, m := range matches {
+		level := strings.ToLower(m.Severity)
+		if _, ok := summary[level]; !ok {
+			level = "unknown"
+		}
+		summary[level]++
+	}
+	return summary
+}
+
+// VulnerabilityMatcher matches SBOM packages against a local grype vulnerability database
+type VulnerabilityMatcher struct {
+	dbDir      string
+	autoUpdate bool
+
+	// mu guards provider, scans hold it for reading so a reload waits for them to finish
+	// before closing the database it replaces
+	mu       sync.RWMutex
+	provider vulnerability.Provider
+}
+
+// NewVulnerabilityMatcher creates a matcher using the database in dbDir, creating the directory if needed.
+// With autoUpdate disabled the database must already be present, which keeps scans offline. With it
+// enabled the database is checked for updates every updateInterval, 0 only checks when it is loaded.
+func NewVulnerabilityMatcher(dbDir string, autoUpdate bool, updateInterval time.Duration) (*VulnerabilityMatcher, error) {
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create vulnerability database directory: %w", err)
+	}
+	m := &VulnerabilityMatcher{dbDir: dbDir, autoUpdate: autoUpdate}
+	if autoUpdate && updateInterval > 0 {
+		go m.updateLoop(updateInterval)
+	}
+	return m, nil
+}
+
+// configs returns the grype settings for the database in m.dbDir
+func (m *VulnerabilityMatcher) configs() (distribution.Config, installation.Config) {
+	id := clio.Identification{Name: "syft-api"}
+	distCfg := distribution.DefaultConfig()
+	distCfg.ID = id
+	installCfg := installation.DefaultConfig(id)
+	installCfg.DBRootDir = m.dbDir
+	return distCfg, installCfg
+}
+
+// database returns the vulnerability database with m.mu held for reading, which the caller must
+// release when done with it. The database is loaded on first use, downloading or updating it
+// when auto update is enabled. A failed load is retried by the next scan.
+func (m *VulnerabilityMatcher) database() (vulnerability.Provider, error) {
+	for {
+		m.mu.RLock()
+		if m.provider != nil {
+			return m.provider, nil
+		}
+		m.mu.RUnlock()
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// load opens the vulnerability database unless another scan already did
+func (m *VulnerabilityMatcher) load() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.provider != nil {
+		return nil
+	}
+
+	distCfg, installCfg := m.configs()
+	provider, status, err := grype.LoadVulnerabilityDB(distCfg, installCfg, m.autoUpdate)
+	if err != nil {
+		return fmt.Errorf("failed to load vulnerability database from %s: %w", m.dbDir, err)
+	}
+	logger.Log(fmt.Sprintf("Loaded vulnerability database %s built %s", status.Path, status.Built))
+	m.provider = provider
+	return nil
+}
+
+// updateLoop periodically updates the loaded vulnerability database
+func (m *VulnerabilityMatcher) updateLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := m.update(); err != nil {
+			logger.Log(fmt.Sprintf("Warning: Could not update the vulnerability database: %v", err))
+		}
+	}
+}
+
+// update downloads a newer vulnerability database when one is available, or when the loaded one
+// has grown too old, and swaps it in once running scans are done with the current one
+func (m *VulnerabilityMatcher) update() error {
+	m.mu.RLock()
+	loaded := m.provider != nil
+	m.mu.RUnlock()
+	if !loaded {
+		return nil // the first scan loads the latest database
+	}
+
+	distCfg, installCfg := m.configs()
+	installCfg.UpdateCheckMaxFrequency = 0 // updateLoop already paces the checks
+	client, err := distribution.NewClient(distCfg)
+	if err != nil {
+		return fmt.Errorf("failed to create database client: %w", err)
+	}
+	curator, err := installation.NewCurator(installCfg, client)
+	if err != nil {
+		return fmt.Errorf("failed to create database curator: %w", err)
+	}
+	updated, err := curator.Update()
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return nil
+	}
+
+	provider, status, err := grype.LoadVulnerabilityDB(distCfg, installCfg, false)
+	if err != nil {
+		return fmt.Errorf("failed to load the updated vulnerability database: %w", err)
+	}
+	m.mu.Lock()
+	previous := m.provider
+	m.provider = provider
+	m.mu.Unlock()
+	logger.Log(fmt.Sprintf("Updated vulnerability database %s built %s", status.Path, status.Built))
+	return previous.Close()
+}
+
+// Match returns every vulnerability found in the packages of an SBOM file, see ScanOptions for filtering
+func (m *VulnerabilityMatcher) Match(ctx context.Context, sbomFile string) ([]VulnerabilityMatch, error) {
+	provider, err := m.database()
+	if err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+
+	packages, pkgContext, _, err := grypepkg.Provide("sbom:"+sbomFile, grypepkg.ProviderConfig{
+		SynthesisConfig: grypepkg.SynthesisConfig{GenerateMissingCPEs: true},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read packages from SBOM: %w", err)
+	}
+
+	vm := grype.VulnerabilityMatcher{
+		VulnerabilityProvider: provider,
+		Matchers:              grypematcher.NewDefaultMatchers(grypematcher.Config{}),
+	}
+	found, _, err := vm.FindMatchesContext(ctx, packages, pkgContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to match vulnerabilities: %w", err)
+	}
+
+	matches := make([]VulnerabilityMatch, 0, found.Count())
+	for _, gm := range found.Sorted() {
+		match := VulnerabilityMatch{
+			ID: gm.Vulnerability.ID,
+			Package: PackageRef{
+				Name:    gm.Package.Name,
+				Version: gm.Package.Version,
+				Type:    string(gm.Package.Type),
+				PURL:    gm.Package.PURL,
+			},
+			FixedVersions: gm.Vulnerability.Fix.Versions,
+			FixState:      string(gm.Vulnerability.Fix.State),
+			Namespace:     gm.Vulnerability.Namespace,
+		}
+		for _, l := range gm.Package.Locations.ToSlice() {
+			match.Locations = append(match.Locations, l.RealPath)
+		}
+		metadata := gm.Vulnerability.Metadata
+		if metadata == nil {
+			metadata, _ = provider.VulnerabilityMetadata(gm.Vulnerability.Reference)
+		}
+		if metadata != nil {
+			match.Severity = metadata.Severity
+			match.DataSource = metadata.DataSource
+			match.URLs = metadata.URLs
+			for _, c := range metadata.Cvss {
+				match.CVSS = append(match.CVSS, CVSSScore{
+					Version:   c.Version,
+					Vector:    c.Vector,
+					BaseScore: c.Metrics.BaseScore,
+					Source:    c.Source,
+				})
+			}
+		}
+		if match.Severity == "" {
+			match.Severity = "Unknown"
+		}
+		matches = append(matches, match)
+	}
+	return matches, nil
+}
+
+// matchTableHeader is the column header of formatMatchTable
+const matchTableHeader = "NAME\tINSTALLED\tFIXED-IN\tTYPE\tVULNERABILITY\tSEVERITY"
+
+// formatMatchTable renders matches as a plain-text table for prompts and the stored scan summary
+func formatMatchTable(matches []VulnerabilityMatch) string {
+	if len(matches) == 0 {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, matchTableHeader)
+	for _, m := range matches {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			m.Package.Name, m.Package.Version, strings.Join(m.FixedVersions, ", "), m.Package.Type, m.ID, m.Severity)
+	}
+	tw.Flush()
+	return buf.String()
+}
+
+// Global vulnerability matcher
+var matcher *VulnerabilityMatcher
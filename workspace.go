@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// workspaceCheckInterval is how often a watched workspace is measured against the quota
+	workspaceCheckInterval = time.Second
+	// unlimitedSize stands in for a size limit that isn't configured
+	unlimitedSize = 1 << 50
+	// workspacePrefix starts the name of every workspace, so sweeping a shared root leaves other files alone
+	workspacePrefix = "syft-api-"
+)
+
+// ErrWorkspaceQuota is returned when a workspace grows past the configured quota
+var ErrWorkspaceQuota = errors.New("workspace quota exceeded")
+
+// WorkspaceManager hands out a private directory under one root to every clone, upload and
+// verification, so concurrent jobs never share files, and removes them when they finish
+type WorkspaceManager struct {
+	root         string
+	quota        int64
+	cloneTimeout time.Duration
+
+	mu     sync.Mutex
+	active map[string]*Workspace
+}
+
+// Workspace is a directory owned by one job, remove it with Close
+type Workspace struct {
+	Dir     string
+	manager *WorkspaceManager
+	once    sync.Once
+}
+
+// NewWorkspaceManager creates a manager rooted at root, removing the workspaces a previous run left behind.
+// quota bounds the size of each workspace in bytes and cloneTimeout bounds each clone, zero disables either.
+func NewWorkspaceManager(root string, quota int64, cloneTimeout time.Duration) (*WorkspaceManager, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create workspace directory: %w", err)
+	}
+	m := &WorkspaceManager{root: root, quota: quota, cloneTimeout: cloneTimeout, active: make(map[string]*Workspace)}
+	if err := m.sweep(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// sweep removes the workspaces a previous run left under the root, called before any workspace
+// of this process exists. Only directories named like a workspace are removed, so a root shared
+// with other files, such as /tmp, keeps them.
+func (m *WorkspaceManager) sweep() error {
+	entries, err := os.ReadDir(m.root)
+	if err != nil {
+		return fmt.Errorf("failed to read workspace directory: %w", err)
+	}
+	removed := 0
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), workspacePrefix) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(m.root, e.Name())); err != nil {
+			return fmt.Errorf("failed to remove orphaned workspace %s: %w", e.Name(), err)
+		}
+		removed++
+	}
+	if removed > 0 {
+		logger.Log(fmt.Sprintf("Removed %d orphaned workspaces from %s", removed, m.root))
+	}
+	return nil
+}
+
+// Create makes a new empty workspace, purpose prefixes its directory name
+func (m *WorkspaceManager) Create(purpose string) (*Workspace, error) {
+	dir, err := os.MkdirTemp(m.root, workspacePrefix+purpose+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s workspace: %w", purpose, err)
+	}
+	w := &Workspace{Dir: dir, manager: m}
+
+	m.mu.Lock()
+	m.active[dir] = w
+	m.mu.Unlock()
+	return w, nil
+}
+
+// Active returns the number of workspaces not yet closed
+func (m *WorkspaceManager) Active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.active)
+}
+
+// CloneContext bounds a clone with the configured timeout
+func (m *WorkspaceManager) CloneContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.cloneTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, m.cloneTimeout)
+}
+
+// Close removes the workspace, it is safe to call more than once
+func (w *Workspace) Close() {
+	w.once.Do(func() {
+		if err := os.RemoveAll(w.Dir); err != nil {
+			logger.Log(fmt.Sprintf("Warning: failed to remove workspace %s: %v", w.Dir, err))
+		}
+		w.manager.mu.Lock()
+		delete(w.manager.active, w.Dir)
+		w.manager.mu.Unlock()
+	})
+}
+
+// Watch returns a context that is canceled once the workspace grows past the quota while
+// files are written into it. stop ends the watch and returns ErrWorkspaceQuota if it was exceeded.
+// The quota is a soft limit: the workspace is measured once every workspaceCheckInterval, so a
+// fast writer can go past it by whatever it writes between two checks before it is stopped.
+func (w *Workspace) Watch(ctx context.Context) (context.Context, func() error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if w.manager.quota <= 0 {
+		return ctx, func() error {
+			cancel(nil)
+			return nil
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(workspaceCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.checkQuota(); errors.Is(err, ErrWorkspaceQuota) {
+					cancel(err)
+					return
+				}
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ctx, func() error {
+		close(done)
+		wg.Wait()
+		defer cancel(nil)
+		if err := context.Cause(ctx); errors.Is(err, ErrWorkspaceQuota) {
+			return err
+		}
+		// Catch growth since the last tick
+		return w.checkQuota()
+	}
+}
+
+// Remaining returns how many more bytes the workspace may hold
+func (w *Workspace) Remaining() (int64, error) {
+	if w.manager.quota <= 0 {
+		return unlimitedSize, nil
+	}
+	size, err := dirSize(w.Dir)
+	if err != nil {
+		return 0, err
+	}
+	if size >= w.manager.quota {
+		return 0, fmt.Errorf("%w: %s uses %d MB, the limit is %d MB", ErrWorkspaceQuota, filepath.Base(w.Dir), size>>20, w.manager.quota>>20)
+	}
+	return w.manager.quota - size, nil
+}
+
+// checkQuota measures the workspace against the quota
+func (w *Workspace) checkQuota() error {
+	size, err := dirSize(w.Dir)
+	if err != nil {
+		return err
+	}
+	if size > w.manager.quota {
+		return fmt.Errorf("%w: %s uses %d MB, the limit is %d MB", ErrWorkspaceQuota, filepath.Base(w.Dir), size>>20, w.manager.quota>>20)
+	}
+	return nil
+}
+
+// dirSize adds up the size of the regular files under dir
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may disappear while a clone or copy is still writing
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure workspace: %w", err)
+	}
+	return size, nil
+}
+
+// Global workspace manager
+var workspaces *WorkspaceManager